@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/biwankaifa/go-util/rabbitmq"
+	"github.com/streadway/amqp"
+)
+
+// headerFlags 可重复的 -header key=value 参数
+type headerFlags amqp.Table
+
+func (h headerFlags) String() string {
+	return ""
+}
+
+func (h headerFlags) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("header格式应为 key=value: %s", s)
+	}
+	h[s[:i]] = s[i+1:]
+	return nil
+}
+
+// newFlagSet 子命令参数, -h 时输出用法
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "用法: mqctl %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runPublish 发布消息, 消息体依次取自 -body、-file、标准输入
+func runPublish(ctx context.Context, args []string) error {
+	fs := newFlagSet("publish", "(-queue 队列 | -exchange 交换机 -key 路由key) [-body 内容 | -file 文件]")
+	queue := fs.String("queue", "", "通过默认交换机投递到队列")
+	exchange := fs.String("exchange", "", "交换机")
+	key := fs.String("key", "", "路由key")
+	body := fs.String("body", "", "消息内容")
+	file := fs.String("file", "", "从文件读取消息内容, - 为标准输入")
+	contentType := fs.String("content-type", rabbitmq.ContentTypeText, "content type")
+	messageID := fs.String("id", "", "消息ID")
+	count := fs.Int("count", 1, "发布次数")
+	delay := fs.Duration("delay", 0, "延迟投递, 仅支持 -queue")
+	headers := headerFlags{}
+	fs.Var(headers, "header", "header, 格式 key=value, 可重复")
+	_ = fs.Parse(args)
+
+	if (*queue == "") == (*exchange == "") {
+		fs.Usage()
+		return errors.New("需要指定 -queue 或 -exchange 其中之一")
+	}
+	data := []byte(*body)
+	if *file != "" {
+		var err error
+		if *file == "-" {
+			data, err = ioutil.ReadAll(bufio.NewReader(os.Stdin))
+		} else {
+			data, err = ioutil.ReadFile(*file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	dns := brokerDNS()
+	opts := []rabbitmq.PublishOption{rabbitmq.WithContentType(*contentType)}
+	if len(headers) > 0 {
+		opts = append(opts, rabbitmq.WithHeaders(amqp.Table(headers)))
+	}
+	if *messageID != "" {
+		opts = append(opts, rabbitmq.WithMessageID(*messageID))
+	}
+	for i := 0; i < *count; i++ {
+		var err error
+		switch {
+		case *delay > 0 && *queue != "":
+			qe := rabbitmq.QueueExchange{QuName: *queue, Dns: dns, SkipDeclare: true}
+			err = rabbitmq.SendDelayedCtx(ctx, qe, string(data), *delay, opts...)
+		case *delay > 0:
+			return errors.New("-delay 仅支持 -queue")
+		case *queue != "":
+			err = rabbitmq.SendTo(ctx, dns, "", *queue, data, opts...)
+		default:
+			err = rabbitmq.SendTo(ctx, dns, *exchange, *key, data, opts...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("已发布 %d 条消息\n", *count)
+	return nil
+}
+
+// runPeek 查看队列消息
+func runPeek(ctx context.Context, args []string) error {
+	fs := newFlagSet("peek", "-queue 队列 [-n 数量]")
+	queue := fs.String("queue", "", "队列")
+	n := fs.Int("n", 10, "查看的消息数量")
+	maxBody := fs.Int("max-body", 1024, "消息内容最多输出的字节数, 0 为不限制")
+	raw := fs.Bool("raw", false, "只输出消息内容, 每条一行")
+	_ = fs.Parse(args)
+	if *queue == "" {
+		fs.Usage()
+		return errors.New("需要指定 -queue")
+	}
+
+	dns := brokerDNS()
+	q, err := rabbitmq.InspectQueue(ctx, dns, *queue)
+	if err != nil {
+		return err
+	}
+	list, err := rabbitmq.Peek(ctx, dns, *queue, *n)
+	if err != nil {
+		return err
+	}
+	if *raw {
+		for _, d := range list {
+			fmt.Println(string(d.Body))
+		}
+		return nil
+	}
+
+	fmt.Printf("队列 %s: %d 条消息, %d 个消费者\n", q.Name, q.Messages, q.Consumers)
+	for i, d := range list {
+		fmt.Printf("\n#%d exchange=%q routing_key=%q redelivered=%t\n", i+1, d.Exchange, d.RoutingKey, d.Redelivered)
+		if d.MessageId != "" {
+			fmt.Printf("  message_id:   %s\n", d.MessageId)
+		}
+		if d.ContentType != "" {
+			fmt.Printf("  content_type: %s\n", d.ContentType)
+		}
+		if !d.Timestamp.IsZero() {
+			fmt.Printf("  timestamp:    %s\n", d.Timestamp.Format(time.RFC3339))
+		}
+		keys := make([]string, 0, len(d.Headers))
+		for k := range d.Headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("  header %s: %v\n", k, d.Headers[k])
+		}
+		b := d.Body
+		if *maxBody > 0 && len(b) > *maxBody {
+			b = b[:*maxBody]
+		}
+		fmt.Printf("  body (%d bytes): %s\n", len(d.Body), b)
+	}
+	return nil
+}
+
+// runMove 移动消息, 未指定目标时移回原始队列
+func runMove(ctx context.Context, args []string) error {
+	fs := newFlagSet("move", "-from 队列 [-to 队列 | -exchange 交换机 -key 路由key] [-n 数量]")
+	from := fs.String("from", "", "源队列, 如 order_retry_5m、order_parked")
+	to := fs.String("to", "", "目标队列, 不指定时按消息记录或队列名推断原始队列")
+	exchange := fs.String("exchange", "", "目标交换机")
+	key := fs.String("key", "", "目标路由key")
+	n := fs.Int("n", 0, "最多移动的消息数量, 0 为全部")
+	reset := fs.Bool("reset", false, "重试次数清零")
+	_ = fs.Parse(args)
+	if *from == "" {
+		fs.Usage()
+		return errors.New("需要指定 -from")
+	}
+
+	moved, err := rabbitmq.Move(ctx, brokerDNS(), *from, rabbitmq.MoveOptions{
+		Queue:      *to,
+		Exchange:   *exchange,
+		RoutingKey: *key,
+		Limit:      *n,
+		ResetRetry: *reset,
+	})
+	fmt.Printf("已移动 %d 条消息\n", moved)
+	return err
+}
+
+// runPurge 清空队列, 未指定 -yes 时需要确认
+func runPurge(ctx context.Context, args []string) error {
+	fs := newFlagSet("purge", "-queue 队列 [-yes]")
+	queue := fs.String("queue", "", "队列")
+	yes := fs.Bool("yes", false, "不需要确认")
+	_ = fs.Parse(args)
+	if *queue == "" {
+		fs.Usage()
+		return errors.New("需要指定 -queue")
+	}
+
+	dns := brokerDNS()
+	if !*yes {
+		q, err := rabbitmq.InspectQueue(ctx, dns, *queue)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("确认清空队列 %s 中的 %d 条消息? [y/N] ", q.Name, q.Messages)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return errors.New("已取消")
+		}
+	}
+	n, err := rabbitmq.PurgeQueue(ctx, dns, *queue)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("已清除 %d 条消息\n", n)
+	return nil
+}
+
+// runTopology 列出配置中的拓扑, -diff 与broker对比, -apply 声明到broker
+func runTopology(ctx context.Context, args []string) error {
+	fs := newFlagSet("topology", "[-key 配置key] [-diff | -apply]")
+	key := fs.String("key", "rabbitmq.topology", "拓扑在配置中的key")
+	diff := fs.Bool("diff", false, "与broker当前状态对比, 不做任何修改")
+	apply := fs.Bool("apply", false, "在broker上声明拓扑")
+	_ = fs.Parse(args)
+
+	t, err := rabbitmq.LoadTopology(loadConfig(), *key)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *apply:
+		if err = t.Apply(ctx, brokerDNS()); err != nil {
+			return err
+		}
+		fmt.Printf("已声明 %d 个交换机, %d 个队列, %d 个绑定\n", len(t.Exchanges), len(t.Queues), len(t.Bindings))
+		return nil
+	case *diff:
+		d, err := t.Diff(ctx, brokerDNS())
+		if err != nil {
+			return err
+		}
+		fmt.Print(d.String())
+		if changes := d.Changes(); len(changes) > 0 {
+			return fmt.Errorf("%d 项需要变更", len(changes))
+		}
+		return nil
+	}
+
+	fmt.Println("exchanges:")
+	for _, e := range t.Exchanges {
+		kind := e.Type
+		if kind == "" {
+			kind = amqp.ExchangeDirect
+		}
+		fmt.Printf("  %-30s %s\n", e.Name, kind)
+	}
+	fmt.Println("queues:")
+	for _, q := range t.Queues {
+		kind := q.Type
+		if kind == "" {
+			kind = "classic"
+		}
+		fmt.Printf("  %-30s %s\n", q.Name, kind)
+	}
+	fmt.Println("bindings:")
+	for _, b := range t.Bindings {
+		switch {
+		case len(b.Headers) > 0:
+			fmt.Printf("  %s -> %s  headers=%v\n", b.Exchange, b.Queue, b.Headers)
+		case len(b.RoutingKeys) > 0:
+			fmt.Printf("  %s -> %s  %s\n", b.Exchange, b.Queue, strings.Join(b.RoutingKeys, ","))
+		default:
+			fmt.Printf("  %s -> %s\n", b.Exchange, b.Queue)
+		}
+	}
+	return nil
+}
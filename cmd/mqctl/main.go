@@ -0,0 +1,132 @@
+// mqctl RabbitMQ队列运维工具, 连接信息从 config 包读取
+//
+//	mqctl [全局参数] <命令> [命令参数]
+//
+//	mqctl -config configs publish -queue order -body '{"id":1}'
+//	mqctl peek -queue order_parked -n 5
+//	mqctl move -from order_retry_5m
+//	mqctl purge -queue order_parked -yes
+//	mqctl topology -diff
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/biwankaifa/go-util/config"
+	"github.com/biwankaifa/go-util/rabbitmq"
+	"github.com/spf13/viper"
+)
+
+// command 子命令
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"publish", "发布消息到交换机或队列", runPublish},
+	{"peek", "查看队列中的消息, 不会移除消息", runPeek},
+	{"move", "将队列中的消息移动到其他队列, 默认移回原始队列", runMove},
+	{"purge", "清空队列", runPurge},
+	{"topology", "列出配置中的拓扑定义, 可与broker对比或声明", runTopology},
+}
+
+// 全局参数
+var (
+	source  = flag.String("source", "file", "配置来源 file/consul")
+	path    = flag.String("config", "configs", "配置目录(file)或kv路径(consul)")
+	cfgType = flag.String("type", "toml", "配置格式")
+	address = flag.String("consul", "", "consul地址, 如 http://127.0.0.1:8500")
+	dnsKey  = flag.String("dns-key", "rabbitmq.dns", "连接地址在配置中的key")
+	connKey = flag.String("conn-key", "", "结构化连接配置在配置中的key, 如 rabbitmq.conn, 指定后不读取 -dns-key")
+	dns     = flag.String("dns", "", "连接地址, 指定后不读取配置")
+	timeout = flag.Duration("timeout", 30*time.Second, "命令超时时间")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		err := c.run(ctx, flag.Args()[1:])
+		cancel()
+		rabbitmq.ClosePublishers()
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "未知命令 %s\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// loadConfig 按全局参数加载配置
+func loadConfig() *viper.Viper {
+	c := config.Config{}
+	c.SetSource(*source).SetPath(*path).SetType(*cfgType).SetAddress(*address)
+	v := config.GetConfig(c)
+	if v == nil {
+		fatal(fmt.Errorf("配置参数不完整, source=%s config=%s", *source, *path))
+	}
+	return v
+}
+
+// connName 结构化连接配置注册的名称
+const connName = "mqctl"
+
+var connRegistered bool
+
+// brokerDNS 连接地址, 优先使用 -dns 参数, 其次 -conn-key 指定的结构化连接配置
+func brokerDNS() string {
+	if *dns != "" {
+		return *dns
+	}
+	if *connKey != "" {
+		if !connRegistered {
+			cfg, err := rabbitmq.LoadConnConfig(loadConfig(), *connKey)
+			if err == nil {
+				err = rabbitmq.RegisterConnConfig(connName, cfg)
+			}
+			if err != nil {
+				fatal(err)
+			}
+			connRegistered = true
+		}
+		return connName
+	}
+	addr := loadConfig().GetString(*dnsKey)
+	if addr == "" {
+		fatal(fmt.Errorf("配置中未找到连接地址 %s", *dnsKey))
+	}
+	return addr
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "用法: mqctl [全局参数] <命令> [命令参数]\n\n命令:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\n全局参数:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\n命令参数: mqctl <命令> -h\n")
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "mqctl: %s\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,164 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"github.com/streadway/amqp"
+)
+
+// 运维用的队列操作: 查看、移动、清空任意队列, 不依赖 QueueExchange 定义
+
+// ErrNoMoveTarget 未指定移动目标, 无法从消息或队列名推断原始队列, 或目标为原队列
+var ErrNoMoveTarget = errors.New("rabbitmq: move target not specified")
+
+// derivedQueue 重试/延迟/停放队列的命名规则, 见 delayTopology 与 ParkingQueueName
+var derivedQueue = regexp.MustCompile(`^(.+?)(_(retry|delay)_\d+(ms|s|m|h)|_parked)$`)
+
+// InspectQueue 被动声明队列, 返回消息数与消费者数, 队列不存在时返回 NOT_FOUND 错误
+func InspectQueue(ctx context.Context, dns, queue string) (amqp.Queue, error) {
+	ch, err := openChannel(ctx, dns)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	return ch.QueueDeclarePassive(queue, false, false, false, false, nil)
+}
+
+// Peek 查看队列头部最多 limit 条消息, 不会移除消息
+// 消息在管道关闭后回到队列, 下次投递时 Redelivered 为 true
+func Peek(ctx context.Context, dns, queue string, limit int) ([]amqp.Delivery, error) {
+	ch, err := openChannel(ctx, dns)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+
+	list := make([]amqp.Delivery, 0)
+	for len(list) < limit {
+		if ctx.Err() != nil {
+			return list, ctx.Err()
+		}
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return list, err
+		}
+		if !ok {
+			break
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// PurgeQueue 清空队列, 返回清除的消息数量
+func PurgeQueue(ctx context.Context, dns, queue string) (int, error) {
+	ch, err := openChannel(ctx, dns)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	return ch.QueuePurge(queue, false)
+}
+
+// SendTo 不声明任何拓扑, 直接发布到已存在的交换机与路由key, exchange 为空时 key 为队列名
+func SendTo(ctx context.Context, dns, exchange, key string, body []byte, opts ...PublishOption) error {
+	return getPublisher(dns).publishTo(ctx, exchange, key, newPublishing(ContentTypeText, body, opts...))
+}
+
+// MoveOptions 移动消息的目标
+// Queue 与 Exchange 都为空时按消息逐条推断: 停放消息记录的原始交换机/路由key,
+// 死信消息 x-death 中的原始交换机/路由key, 最后按队列命名规则去掉 _retry_5m/_delay_1s/_parked 后缀
+type MoveOptions struct {
+	Queue      string // 通过默认交换机投递到该队列
+	Exchange   string // 投递到交换机
+	RoutingKey string // 与 Exchange 配合使用
+	Limit      int    // 最多移动的消息数量, 小于等于0时移动全部
+	ResetRetry bool   // 重试次数清零
+}
+
+// target 单条消息的目标交换机与路由key
+func (o MoveOptions) target(from string, d amqp.Delivery) (string, string, bool) {
+	if o.Queue != "" {
+		return "", o.Queue, true
+	}
+	if o.Exchange != "" {
+		return o.Exchange, o.RoutingKey, true
+	}
+	m := newParkedMessage(d)
+	if m.Exchange != "" || m.RoutingKey != "" {
+		return m.Exchange, m.RoutingKey, true
+	}
+	// x-death 最近一次死信记录在最前
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	for _, v := range deaths {
+		death, ok := v.(amqp.Table)
+		if !ok || death["queue"] == from {
+			continue
+		}
+		exchange, _ := death["exchange"].(string)
+		keys, _ := death["routing-keys"].([]interface{})
+		if len(keys) > 0 {
+			if key, ok := keys[0].(string); ok {
+				return exchange, key, true
+			}
+		}
+		break
+	}
+	if s := derivedQueue.FindStringSubmatch(from); s != nil {
+		return "", s[1], true
+	}
+	return "", "", false
+}
+
+// Move 将队列中的消息逐条重新发布到目标, broker确认后再从原队列移除
+// 返回成功移动的数量, 发布失败的消息保留在原队列中
+func Move(ctx context.Context, dns, from string, opts MoveOptions) (int, error) {
+	ch, err := openChannel(ctx, dns)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+
+	publisher := getPublisher(dns)
+	moved := 0
+	for opts.Limit <= 0 || moved < opts.Limit {
+		if ctx.Err() != nil {
+			return moved, ctx.Err()
+		}
+		d, ok, err := ch.Get(from, false)
+		if err != nil {
+			return moved, err
+		}
+		if !ok {
+			break
+		}
+		exchange, key, ok := opts.target(from, d)
+		if !ok || (exchange == "" && key == from) {
+			_ = d.Nack(false, true)
+			return moved, ErrNoMoveTarget
+		}
+		msg := replayPublishing(d)
+		if !opts.ResetRetry {
+			msg.Headers["retry_nums"] = retryCount(d)
+		}
+		if err = publisher.publishTo(ctx, exchange, key, msg); err != nil {
+			_ = d.Nack(false, true)
+			return moved, err
+		}
+		if err = d.Ack(false); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
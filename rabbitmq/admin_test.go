@@ -0,0 +1,170 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// queueMessages 等待队列中有n条消息并返回
+func queueMessages(t *testing.T, b *MemoryBroker, queue string, n int) []amqp.Delivery {
+	t.Helper()
+	waitFor(t, queue, func() bool {
+		ready, _ := b.QueueDepth(queue)
+		return ready == n
+	})
+	return b.Messages(queue)
+}
+
+func TestMoveFromParked(t *testing.T) {
+	b := newTestBroker(t)
+	qe := QueueExchange{
+		QuName: "job",
+		ExName: "job_ex",
+		ExType: amqp.ExchangeDirect,
+		RtKey:  "job",
+		Dns:    b.DNS(),
+		Retry:  &RetryPolicy{MaxAttempts: 2, Backoff: []time.Duration{10 * time.Millisecond}},
+	}
+	// 消费者在移动前退出, 移回的消息留在原队列中
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	r := &testReceiver{qe: qe, handle: func(amqp.Delivery) error { return errors.New("fail") }}
+	go func() {
+		defer close(done)
+		_ = RecvCtx(ctx, qe, r, 1)
+	}()
+	if err := Send(qe, "payload"); err != nil {
+		t.Fatal(err)
+	}
+	parked := queueMessages(t, b, ParkingQueueName(qe), 1)
+	cancel()
+	<-done
+	want := retryCount(parked[0])
+	if want == 0 {
+		t.Fatal("parked message has no retry_nums")
+	}
+
+	n, err := Move(context.Background(), b.DNS(), ParkingQueueName(qe), MoveOptions{})
+	if err != nil || n != 1 {
+		t.Fatalf("Move = %d, %v, want 1", n, err)
+	}
+	got := queueMessages(t, b, "job", 1)
+	if string(got[0].Body) != "payload" || got[0].Exchange != "job_ex" {
+		t.Fatalf("moved %q via %q, want payload via job_ex", got[0].Body, got[0].Exchange)
+	}
+	if n := retryCount(got[0]); n != want {
+		t.Fatalf("retry_nums = %d, want %d", n, want)
+	}
+	if ready, _ := b.QueueDepth(ParkingQueueName(qe)); ready != 0 {
+		t.Fatalf("parking depth = %d after move, want 0", ready)
+	}
+}
+
+func TestMoveFromRetryQueue(t *testing.T) {
+	b := newTestBroker(t)
+	ctx := context.Background()
+	topo := &Topology{Queues: []QueueSpec{{Name: "job"}, {Name: "job_retry_5m"}}}
+	if err := topo.Apply(ctx, b.DNS()); err != nil {
+		t.Fatal(err)
+	}
+	headers := amqp.Table{"retry_nums": int32(2)}
+	for _, body := range []string{"1", "2"} {
+		if err := SendTo(ctx, b.DNS(), "", "job_retry_5m", []byte(body), WithHeaders(headers)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 按命名规则去掉 _retry_5m 后缀
+	n, err := Move(ctx, b.DNS(), "job_retry_5m", MoveOptions{Limit: 1})
+	if err != nil || n != 1 {
+		t.Fatalf("Move = %d, %v, want 1", n, err)
+	}
+	got := queueMessages(t, b, "job", 1)
+	if string(got[0].Body) != "1" || retryCount(got[0]) != 2 {
+		t.Fatalf("moved %q with retry_nums %d, want 1 with 2", got[0].Body, retryCount(got[0]))
+	}
+
+	n, err = Move(ctx, b.DNS(), "job_retry_5m", MoveOptions{ResetRetry: true})
+	if err != nil || n != 1 {
+		t.Fatalf("Move = %d, %v, want 1", n, err)
+	}
+	got = queueMessages(t, b, "job", 2)
+	if string(got[1].Body) != "2" || retryCount(got[1]) != 0 {
+		t.Fatalf("moved %q with retry_nums %d, want 2 with 0", got[1].Body, retryCount(got[1]))
+	}
+}
+
+func TestMoveFromDeadLetterQueue(t *testing.T) {
+	b := newTestBroker(t)
+	ctx := context.Background()
+	topo := &Topology{
+		Exchanges: []ExchangeSpec{{Name: "src_ex"}, {Name: "dlx", Type: amqp.ExchangeFanout}},
+		Queues:    []QueueSpec{{Name: "src", DeadLetterExchange: "dlx"}, {Name: "dlq"}},
+		Bindings: []BindingSpec{
+			{Queue: "src", Exchange: "src_ex", RoutingKeys: []string{"k"}},
+			{Queue: "dlq", Exchange: "dlx"},
+		},
+	}
+	if err := topo.Apply(ctx, b.DNS()); err != nil {
+		t.Fatal(err)
+	}
+	headers := amqp.Table{"retry_nums": int32(1)}
+	if err := SendTo(ctx, b.DNS(), "src_ex", "k", []byte("dead"), WithHeaders(headers)); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := openChannel(ctx, b.DNS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	d, ok, err := ch.Get("src", false)
+	if err != nil || !ok {
+		t.Fatalf("Get = %v, %v", ok, err)
+	}
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	queueMessages(t, b, "dlq", 1)
+
+	// 按 x-death 记录回到原始交换机与路由key
+	n, err := Move(ctx, b.DNS(), "dlq", MoveOptions{})
+	if err != nil || n != 1 {
+		t.Fatalf("Move = %d, %v, want 1", n, err)
+	}
+	got := queueMessages(t, b, "src", 1)
+	if string(got[0].Body) != "dead" || got[0].Exchange != "src_ex" || got[0].RoutingKey != "k" {
+		t.Fatalf("moved %q via %q/%q, want dead via src_ex/k", got[0].Body, got[0].Exchange, got[0].RoutingKey)
+	}
+	if n := retryCount(got[0]); n != 1 {
+		t.Fatalf("retry_nums = %d, want 1", n)
+	}
+}
+
+func TestMoveNoTarget(t *testing.T) {
+	b := newTestBroker(t)
+	ctx := context.Background()
+	topo := &Topology{Queues: []QueueSpec{{Name: "plain"}}}
+	if err := topo.Apply(ctx, b.DNS()); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendTo(ctx, b.DNS(), "", "plain", []byte("stay")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 无法推断目标, 以及目标为原队列时, 消息都留在原队列
+	for _, opts := range []MoveOptions{{}, {Queue: "plain"}} {
+		n, err := Move(ctx, b.DNS(), "plain", opts)
+		if !errors.Is(err, ErrNoMoveTarget) || n != 0 {
+			t.Fatalf("Move(%+v) = %d, %v, want ErrNoMoveTarget", opts, n, err)
+		}
+		if got := queueMessages(t, b, "plain", 1); string(got[0].Body) != "stay" {
+			t.Fatalf("message = %q, want stay", got[0].Body)
+		}
+	}
+}
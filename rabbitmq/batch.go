@@ -0,0 +1,206 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// BatchReceiver 批量消费接口, 每次收到最多 QueueExchange.BatchSize 条消息
+// 返回nil时整批确认; 返回 *BatchError 时其中的消息按失败进入重试/停放, 其余消息确认; 返回其他错误时整批按失败处理
+// 消费中间件按单条消息设计, 不会应用到批量消费
+type BatchReceiver interface {
+	Options() QueueExchange
+	ConsumeBatch(ctx context.Context, list []amqp.Delivery) error
+	FailAction(error, []byte) error
+}
+
+// BatchError 批量消费中部分消息处理失败
+type BatchError struct {
+	Errors map[int]error // 失败消息在批次中的下标与原因
+}
+
+// NewBatchError 创建空的部分失败错误
+func NewBatchError() *BatchError {
+	return &BatchError{Errors: make(map[int]error)}
+}
+
+// Add 记录第 i 条消息处理失败
+func (e *BatchError) Add(i int, err error) {
+	e.Errors[i] = err
+}
+
+// Err 没有失败的消息时返回nil, 便于直接作为 ConsumeBatch 的返回值
+func (e *BatchError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Error error接口实现
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("rabbitmq: %d messages in batch failed", len(e.Errors))
+}
+
+// RecvBatch 批量消费者, ctx 结束时处理完已收到的消息后退出
+// runNums 开启并发执行任务数量, 预取数量不小于 BatchSize
+func RecvBatch(ctx context.Context, queueExchange QueueExchange, receiver BatchReceiver, runNums int) error {
+	return serve(ctx, queueExchange, runNums, func(mq *RabbitMQ, routineNum int) {
+		mq.ListenBatchReceiverCtx(ctx, receiver, routineNum)
+	})
+}
+
+// ListenBatchReceiverCtx 监听批量接收者, 连接或管道断开后会等待连接恢复并继续消费
+func (mq *RabbitMQ) ListenBatchReceiverCtx(ctx context.Context, receiver BatchReceiver, routineNum int) {
+	mq.listen(ctx, routineNum, func() (bool, error) {
+		return mq.consumeBatch(ctx, receiver, routineNum)
+	})
+}
+
+// batchOptions 生效的批量大小与等待时间
+func (mq *RabbitMQ) batchOptions() (size int, wait time.Duration) {
+	size, wait = mq.queueExchange.BatchSize, mq.queueExchange.BatchWait
+	if size <= 0 {
+		size = 100
+	}
+	if wait <= 0 {
+		wait = time.Second
+	}
+	return
+}
+
+// consumeBatch 凑满一批或等待超时后调用接收者, 直到管道关闭或ctx结束
+func (mq *RabbitMQ) consumeBatch(ctx context.Context, receiver BatchReceiver, routineNum int) (started bool, err error) {
+	size, wait := mq.batchOptions()
+	prefetch := mq.queueExchange.Prefetch
+	if prefetch < size {
+		prefetch = size
+	}
+	sub, err := mq.subscribe(routineNum, prefetch)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = sub.ch.Close()
+	}()
+
+	batch := make([]amqp.Delivery, 0, size)
+	timer := time.NewTimer(wait)
+	stopTimer(timer)
+	defer timer.Stop()
+	flush := func() {
+		// 停止时已触发的信号需要取出, 否则下一批收到第一条消息后会立即被提交
+		stopTimer(timer)
+		if len(batch) == 0 {
+			return
+		}
+		mq.handleBatch(batch, receiver, routineNum)
+		batch = make([]amqp.Delivery, 0, size)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if err := sub.ch.Cancel(sub.tag, false); err != nil {
+				log.Printf("[%s#%d] Cancel err :%s \n", mq.QueueName, routineNum, err)
+			}
+			// 已收到的消息处理完再退出
+			flush()
+			return true, ctx.Err()
+		case <-timer.C:
+			flush()
+		case msg, ok := <-sub.deliveries:
+			if !ok {
+				// 管道已关闭, 未确认的消息会被broker重新投递
+				return true, sub.closeReason()
+			}
+			if remaining := delayRemaining(msg); remaining > 0 {
+				mq.redelay(msg, remaining, routineNum)
+				continue
+			}
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				timer.Reset(wait)
+			}
+			if len(batch) >= size {
+				flush()
+			}
+		}
+	}
+}
+
+// stopTimer 停止定时器并取出已触发未读取的信号, 之后可安全地 Reset
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// handleBatch 处理一批消息并确认, 全部成功时一次确认整批
+func (mq *RabbitMQ) handleBatch(batch []amqp.Delivery, receiver BatchReceiver, routineNum int) {
+	span, ctx := startFollowSpan(context.Background(), "rabbitmq.consume_batch", batch[0].Headers)
+	if span != nil {
+		span.SetTag("rabbitmq.queue", mq.QueueName)
+		span.SetTag("rabbitmq.batch_size", len(batch))
+	}
+	for _, msg := range batch {
+		metrics().MessageConsumed(mq.QueueName, lag(msg))
+	}
+	start := time.Now()
+	err := mq.consumeBatchMsg(ctx, receiver, batch)
+	metrics().ObserveHandler(mq.QueueName, time.Since(start), err)
+	defer func() {
+		finishSpan(span, err)
+	}()
+
+	if err == nil {
+		if ackErr := batch[len(batch)-1].Ack(true); ackErr != nil {
+			fmt.Printf("[%s#%d] 批量消息ack失败 err :%s \n", mq.QueueName, routineNum, ackErr)
+		} else {
+			metrics().MessageAcked(mq.QueueName, len(batch))
+		}
+		return
+	}
+
+	batchErr, partial := err.(*BatchError)
+	for i, msg := range batch {
+		msgErr := err
+		if partial {
+			var failed bool
+			if msgErr, failed = batchErr.Errors[i]; !failed {
+				if ackErr := msg.Ack(false); ackErr != nil {
+					fmt.Printf("[%s#%d] 消息消费ack失败 err :%s \n", mq.QueueName, routineNum, ackErr)
+				} else {
+					metrics().MessageAcked(mq.QueueName, 1)
+				}
+				continue
+			}
+			if msgErr == nil {
+				msgErr = err
+			}
+		}
+		mq.fail(ctx, msg, retryCount(msg), msgErr, receiver.FailAction, routineNum)
+	}
+}
+
+// consumeBatchMsg 调用接收者, panic 按整批失败处理
+func (mq *RabbitMQ) consumeBatchMsg(ctx context.Context, receiver BatchReceiver, batch []amqp.Delivery) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+			log.Printf("[%s] 批量消息处理panic :%v \n%s", mq.QueueName, r, err.(*PanicError).Stack)
+		}
+	}()
+	err = receiver.ConsumeBatch(ctx, batch)
+	if batchErr, ok := err.(*BatchError); ok && len(batchErr.Errors) == 0 {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package rabbitmq
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type testBatchReceiver struct {
+	qe QueueExchange
+
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (r *testBatchReceiver) Options() QueueExchange         { return r.qe }
+func (r *testBatchReceiver) FailAction(error, []byte) error { return nil }
+func (r *testBatchReceiver) ConsumeBatch(_ context.Context, list []amqp.Delivery) error {
+	r.mu.Lock()
+	r.sizes = append(r.sizes, len(list))
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *testBatchReceiver) batches() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int{}, r.sizes...)
+}
+
+func TestStopTimerDrainsFiredTick(t *testing.T) {
+	timer := time.NewTimer(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	stopTimer(timer)
+	timer.Reset(time.Hour)
+	select {
+	case <-timer.C:
+		t.Fatal("stale tick delivered after Reset")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRecvBatchFlush(t *testing.T) {
+	b := newTestBroker(t)
+	qe := QueueExchange{QuName: "batch", Dns: b.DNS(), BatchSize: 3, BatchWait: 50 * time.Millisecond}
+	r := &testBatchReceiver{qe: qe}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = RecvBatch(ctx, qe, r, 1)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for i := 0; i < 7; i++ {
+		if err := Send(qe, "payload"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "3 batches", func() bool { return len(r.batches()) == 3 })
+	if got := r.batches(); !reflect.DeepEqual(got, []int{3, 3, 1}) {
+		t.Fatalf("batches = %v", got)
+	}
+
+	// 上一批按等待时间提交后, 下一批仍等待完整的 BatchWait
+	for i := 0; i < 2; i++ {
+		if err := Send(qe, "payload"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "4 batches", func() bool { return len(r.batches()) == 4 })
+	if got := r.batches(); got[3] != 2 {
+		t.Fatalf("batches = %v", got)
+	}
+}
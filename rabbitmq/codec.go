@@ -0,0 +1,151 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// 常用的 content-type
+const (
+	ContentTypeText     = "text/plain"
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeProtobuf = "application/protobuf"
+)
+
+// DefaultContentType 类型化消息未指定 content-type 时使用的编码
+var DefaultContentType = ContentTypeJSON
+
+// Codec 消息体编解码器, 按 content-type 选择
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecMu sync.RWMutex
+	codecs  = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(MsgpackCodec{})
+	RegisterCodec(ProtobufCodec{})
+	RegisterCodec(TextCodec{})
+	// 兼容常见的别名
+	RegisterCodecAs("application/x-msgpack", MsgpackCodec{})
+	RegisterCodecAs("application/x-protobuf", ProtobufCodec{})
+}
+
+// RegisterCodec 注册编解码器, 相同 content-type 会被覆盖
+func RegisterCodec(c Codec) {
+	RegisterCodecAs(c.ContentType(), c)
+}
+
+// RegisterCodecAs 以指定的 content-type 注册编解码器
+func RegisterCodecAs(contentType string, c Codec) {
+	codecMu.Lock()
+	codecs[normalizeContentType(contentType)] = c
+	codecMu.Unlock()
+}
+
+// CodecFor 获取 content-type 对应的编解码器, 空 content-type 视为 text/plain
+func CodecFor(contentType string) (Codec, error) {
+	ct := normalizeContentType(contentType)
+	if ct == "" {
+		ct = ContentTypeText
+	}
+	codecMu.RLock()
+	c, ok := codecs[ct]
+	codecMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("rabbitmq: no codec registered for content-type %q", contentType)
+	}
+	return c, nil
+}
+
+// normalizeContentType 去掉 charset 等参数并转为小写
+func normalizeContentType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	ct, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return ct
+}
+
+// JSONCodec application/json
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string { return ContentTypeJSON }
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// MsgpackCodec application/msgpack
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// ProtobufCodec application/protobuf, 只支持 proto.Message
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("rabbitmq: %T does not implement proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("rabbitmq: %T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// TextCodec text/plain, 兼容旧版本的字符串消息
+// 支持 string/[]byte, 其他类型按JSON处理
+type TextCodec struct{}
+
+func (TextCodec) ContentType() string { return ContentTypeText }
+
+func (TextCodec) Marshal(v interface{}) ([]byte, error) {
+	switch s := v.(type) {
+	case string:
+		return []byte(s), nil
+	case []byte:
+		return s, nil
+	}
+	return json.Marshal(v)
+}
+
+func (TextCodec) Unmarshal(data []byte, v interface{}) error {
+	switch s := v.(type) {
+	case *string:
+		*s = string(data)
+		return nil
+	case *[]byte:
+		*s = append((*s)[:0], data...)
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,130 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrNack broker拒绝了消息
+	ErrNack = errors.New("rabbitmq: message nacked by broker")
+	// ErrPublishTimeout 等待broker确认超时
+	ErrPublishTimeout = errors.New("rabbitmq: publish confirm timeout")
+	// ErrUnroutable 消息无法路由到任何队列
+	ErrUnroutable = errors.New("rabbitmq: message unroutable")
+)
+
+// PublishTimeout Send 等待broker确认的默认超时时间
+var PublishTimeout = 5 * time.Second
+
+// PublishError 消息发布失败
+type PublishError struct {
+	Kind       error  // ErrNack / ErrPublishTimeout / ErrUnroutable 或底层错误
+	Exchange   string // 交换机名称
+	RoutingKey string // 路由key
+	ReplyCode  uint16 // 不可路由时broker返回的code
+	ReplyText  string // 不可路由时broker返回的原因
+}
+
+// Error error接口实现
+func (e *PublishError) Error() string {
+	if e.ReplyText != "" {
+		return fmt.Sprintf("%s (exchange=%q routing_key=%q reply=%d %s)", e.Kind, e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+	}
+	return fmt.Sprintf("%s (exchange=%q routing_key=%q)", e.Kind, e.Exchange, e.RoutingKey)
+}
+
+// Unwrap 支持 errors.Is(err, ErrNack) 等判断
+func (e *PublishError) Unwrap() error {
+	return e.Kind
+}
+
+// timeoutError ctx结束导致的发布超时, errors.Is 可同时判断 ErrPublishTimeout 与 ctx 的错误
+type timeoutError struct {
+	cause error
+}
+
+// publishTimeout 包装ctx结束的原因
+func publishTimeout(ctx context.Context) error {
+	return &timeoutError{cause: ctx.Err()}
+}
+
+// Error error接口实现
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrPublishTimeout, e.cause)
+}
+
+// Is 匹配 ErrPublishTimeout
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrPublishTimeout
+}
+
+// Unwrap 返回ctx结束的原因
+func (e *timeoutError) Unwrap() error {
+	return e.cause
+}
+
+// confirmChannel confirm模式的管道, 同一时间只能被一个协程使用
+type confirmChannel struct {
+	ch       channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	closes   chan *amqp.Error
+}
+
+// newConfirmChannel 将管道切换为confirm模式
+func newConfirmChannel(ch channel) (*confirmChannel, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+	return &confirmChannel{
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 1)),
+		closes:   ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}, nil
+}
+
+// alive 管道是否仍然可用
+func (c *confirmChannel) alive() bool {
+	select {
+	case <-c.closes:
+		return false
+	default:
+		return true
+	}
+}
+
+// publish 发布一条消息, 直到broker确认或ctx结束才返回
+// mandatory 开启, 无法路由的消息会以 ErrUnroutable 返回
+// 返回 ErrPublishTimeout 后管道内还残留未读取的确认, 调用方需丢弃该管道
+func (c *confirmChannel) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if err := c.ch.Publish(exchange, key, true, false, msg); err != nil {
+		return &PublishError{Kind: err, Exchange: exchange, RoutingKey: key}
+	}
+
+	select {
+	case confirm, ok := <-c.confirms:
+		if !ok {
+			return &PublishError{Kind: amqp.ErrClosed, Exchange: exchange, RoutingKey: key}
+		}
+		// broker会先发送 basic.return 再发送 ack, 此时 return 已经在chan中
+		select {
+		case r, ok := <-c.returns:
+			if ok {
+				return &PublishError{Kind: ErrUnroutable, Exchange: exchange, RoutingKey: key, ReplyCode: r.ReplyCode, ReplyText: r.ReplyText}
+			}
+		default:
+		}
+		if !confirm.Ack {
+			return &PublishError{Kind: ErrNack, Exchange: exchange, RoutingKey: key}
+		}
+		return nil
+	case <-ctx.Done():
+		return &PublishError{Kind: publishTimeout(ctx), Exchange: exchange, RoutingKey: key}
+	}
+}
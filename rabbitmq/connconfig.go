@@ -0,0 +1,261 @@
+package rabbitmq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/biwankaifa/go-util/config"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// ConnConfig 结构化连接配置, 通过 RegisterConnConfig 注册后将 QueueExchange.Dns 设为注册的名称即可使用
+// 连接与断线重连时按 Hosts 的顺序依次尝试, 直到有节点连接成功
+//
+// 配置文件示例(toml):
+//
+//	[rabbitmq.conn]
+//	hosts = ["mq1:5671", "mq2:5671", "mq3:5671"]
+//	vhost = "order"
+//	external = true
+//	connection_name = "order-service"
+//	[rabbitmq.conn.tls]
+//	enable = true
+//	ca_cert = "/etc/rabbitmq/ca.pem"
+//	cert = "/etc/rabbitmq/client.pem"
+//	key = "/etc/rabbitmq/client-key.pem"
+type ConnConfig struct {
+	Hosts          []string      `mapstructure:"hosts"`           // 集群节点 host 或 host:port, 端口默认5672, 开启TLS时默认5671
+	Username       string        `mapstructure:"username"`        // 默认 guest
+	Password       string        `mapstructure:"password"`        // 默认 guest
+	Vhost          string        `mapstructure:"vhost"`           // 默认 /
+	External       bool          `mapstructure:"external"`        // 使用 SASL EXTERNAL 认证, 由客户端证书确定用户, 需要开启TLS
+	Heartbeat      time.Duration `mapstructure:"heartbeat"`       // 心跳间隔, 默认10秒
+	ChannelMax     int           `mapstructure:"channel_max"`     // 最大管道数量, 0 为使用服务端的限制
+	ConnectionName string        `mapstructure:"connection_name"` // 在管理界面展示的连接名称, 默认 主机名-进程号
+	DialTimeout    time.Duration `mapstructure:"dial_timeout"`    // 单个节点的连接超时, 默认5秒
+	TLSFiles       TLSFiles      `mapstructure:"tls"`             // 从文件加载的TLS配置, TLS 不为空时忽略
+	TLS            *tls.Config   `mapstructure:"-"`               // TLS配置, 不为空时使用 amqps 连接
+}
+
+// TLSFiles 从文件加载的TLS配置
+type TLSFiles struct {
+	Enable             bool   `mapstructure:"enable"`
+	CACert             string `mapstructure:"ca_cert"` // 服务端证书的CA, 为空时使用系统CA
+	Cert               string `mapstructure:"cert"`    // 客户端证书, 双向认证或 External 时需要
+	Key                string `mapstructure:"key"`     // 客户端证书私钥
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// externalAuth SASL EXTERNAL 认证, 用户由TLS客户端证书确定, 需要broker启用 rabbitmq_auth_mechanism_ssl 插件
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string { return "EXTERNAL" }
+func (externalAuth) Response() string  { return "" }
+
+var (
+	connConfigMu sync.RWMutex
+	connConfigs  = make(map[string]*ConnConfig)
+)
+
+// RegisterConnConfig 校验并注册连接配置, 同名配置已存在时替换, 已创建的共享生产者会被关闭
+// 注册后 QueueExchange.Dns 设为 name 即使用该配置连接
+// 消费者的连接每次重连时重新读取配置, 替换配置不会断开已建立的消费连接, 下次重连后生效
+func RegisterConnConfig(name string, cfg ConnConfig) error {
+	if name == "" || strings.Contains(name, "://") {
+		return fmt.Errorf("rabbitmq: invalid connection name %q", name)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.TLS == nil && cfg.TLSFiles.Enable {
+		c, err := cfg.TLSFiles.Load()
+		if err != nil {
+			return err
+		}
+		cfg.TLS = c
+	}
+	cfg.Hosts = append([]string{}, cfg.Hosts...)
+
+	connConfigMu.Lock()
+	connConfigs[name] = &cfg
+	connConfigMu.Unlock()
+	closePublisher(name)
+	return nil
+}
+
+// LoadConnConfig 从配置中读取连接配置
+func LoadConnConfig(v *viper.Viper, key string) (ConnConfig, error) {
+	cfg := ConnConfig{}
+	if v == nil {
+		return cfg, errors.New("rabbitmq: config not initialized")
+	}
+	if err := v.UnmarshalKey(key, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// ConnConfigFromConfig 从 config.DefaultConfig 中读取连接配置
+func ConnConfigFromConfig(key string) (ConnConfig, error) {
+	return LoadConnConfig(config.DefaultConfig, key)
+}
+
+// lookupConnConfig 名称对应的连接配置, 未注册时返回nil
+func lookupConnConfig(name string) *ConnConfig {
+	connConfigMu.RLock()
+	defer connConfigMu.RUnlock()
+	return connConfigs[name]
+}
+
+// Validate 校验配置是否完整
+func (cfg ConnConfig) Validate() error {
+	if len(cfg.Hosts) == 0 {
+		return errors.New("rabbitmq: at least one host is required")
+	}
+	for _, h := range cfg.Hosts {
+		if h == "" {
+			return errors.New("rabbitmq: empty host")
+		}
+	}
+	if cfg.External && !cfg.tls() {
+		return errors.New("rabbitmq: external auth requires tls")
+	}
+	return nil
+}
+
+// Load 加载证书文件
+func (f TLSFiles) Load() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         f.ServerName,
+		InsecureSkipVerify: f.InsecureSkipVerify,
+	}
+	if f.CACert != "" {
+		pem, err := ioutil.ReadFile(f.CACert)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("rabbitmq: no certificate found in %s", f.CACert)
+		}
+	}
+	if f.Cert != "" || f.Key != "" {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// tls 是否使用TLS连接
+func (cfg *ConnConfig) tls() bool {
+	return cfg.TLS != nil || cfg.TLSFiles.Enable
+}
+
+// addr 不含账号密码的地址, 用于日志与事件
+func (cfg *ConnConfig) addr() string {
+	scheme := "amqp"
+	if cfg.tls() {
+		scheme = "amqps"
+	}
+	vhost := cfg.Vhost
+	if vhost == "" {
+		vhost = "/"
+	}
+	return fmt.Sprintf("%s://%s/%s", scheme, strings.Join(cfg.Hosts, ","), vhost)
+}
+
+// hostPort 补全默认端口
+func (cfg *ConnConfig) hostPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if cfg.tls() {
+		return net.JoinHostPort(host, "5671")
+	}
+	return net.JoinHostPort(host, "5672")
+}
+
+// amqpConfig 连接参数, 每次连接都重新生成, 底层库会修改其中的TLS与属性
+func (cfg *ConnConfig) amqpConfig() amqp.Config {
+	c := amqp.Config{
+		Vhost:      cfg.Vhost,
+		ChannelMax: cfg.ChannelMax,
+		Heartbeat:  cfg.Heartbeat,
+		Locale:     "en_US",
+	}
+	if c.Vhost == "" {
+		c.Vhost = "/"
+	}
+	if c.Heartbeat <= 0 {
+		c.Heartbeat = 10 * time.Second
+	}
+	timeout := cfg.DialTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	c.Dial = amqp.DefaultDial(timeout)
+
+	if cfg.External {
+		c.SASL = []amqp.Authentication{externalAuth{}}
+	} else {
+		user, password := cfg.Username, cfg.Password
+		if user == "" && password == "" {
+			user, password = "guest", "guest"
+		}
+		c.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: user, Password: password}}
+	}
+
+	if cfg.TLS != nil {
+		// 未指定 ServerName 时底层库会设为当前节点的host
+		c.TLSClientConfig = cfg.TLS.Clone()
+	}
+
+	name := cfg.ConnectionName
+	if name == "" {
+		hostname, _ := os.Hostname()
+		name = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	c.Properties = amqp.Table{
+		"product":         "go-util/rabbitmq",
+		"connection_name": name,
+	}
+	return c
+}
+
+// dial 按顺序尝试各节点, 全部失败时返回最后一个错误
+func (cfg *ConnConfig) dial() (*amqp.Connection, error) {
+	var lastErr error
+	for i, h := range cfg.Hosts {
+		host := cfg.hostPort(h)
+		scheme := "amqp"
+		if cfg.tls() {
+			scheme = "amqps"
+		}
+		conn, err := amqp.DialConfig(scheme+"://"+host+"/", cfg.amqpConfig())
+		if err == nil {
+			if i > 0 {
+				log.Printf("[rabbitmq] 已连接到节点 %s \n", host)
+			}
+			return conn, nil
+		}
+		lastErr = err
+		if i < len(cfg.Hosts)-1 {
+			log.Printf("[rabbitmq] 连接节点 %s 失败, 尝试下一个节点: %s \n", host, err)
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,375 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ConnState 连接状态
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota // 未连接
+	StateConnecting                    // 首次连接中
+	StateConnected                     // 已连接
+	StateReconnecting                  // 断线重连中
+	StateClosed                        // 已主动关闭
+)
+
+// String 状态名称
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// StateEvent 连接状态变更事件
+type StateEvent struct {
+	Addr    string    // 连接地址(不含账号密码)
+	State   ConnState // 当前状态
+	Err     error     // 导致状态变更的错误
+	Attempt int       // 重连尝试次数
+	Time    time.Time // 事件时间
+}
+
+var (
+	// ErrNotConnected 当前没有可用的连接
+	ErrNotConnected = errors.New("rabbitmq: not connected")
+	// ErrConnectionClosed 连接已被主动关闭
+	ErrConnectionClosed = errors.New("rabbitmq: connection closed")
+)
+
+var (
+	// MinReconnectDelay 重连最小间隔
+	MinReconnectDelay = time.Second
+	// MaxReconnectDelay 重连最大间隔
+	MaxReconnectDelay = 30 * time.Second
+)
+
+// 全局状态监听者, 接收所有连接的状态事件
+var (
+	stateMu        sync.RWMutex
+	stateListeners []chan StateEvent
+)
+
+// NotifyState 注册全局连接状态监听, 建议传入带缓冲的chan, 监听者处理过慢时事件会被丢弃
+func NotifyState(receiver chan StateEvent) chan StateEvent {
+	stateMu.Lock()
+	stateListeners = append(stateListeners, receiver)
+	stateMu.Unlock()
+	return receiver
+}
+
+// channel 内部使用的管道操作, *amqp.Channel 与内存broker的管道均实现该接口
+type channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDelete(name string, ifUnused, noWait bool) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueInspect(name string) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueuePurge(name string, noWait bool) (int, error)
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Get(queue string, autoAck bool) (msg amqp.Delivery, ok bool, err error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+var _ channel = (*amqp.Channel)(nil)
+
+// Connection 自愈连接, 断线后按退避策略自动重连
+type Connection struct {
+	dns  string
+	addr string
+
+	mu        sync.RWMutex
+	conn      *amqp.Connection
+	state     ConnState
+	ready     chan struct{} // 连接可用时关闭, 断线后重新创建
+	listeners []chan StateEvent
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConnection 创建自愈连接对象, 需调用 Connect 后才会建立连接
+func NewConnection(dns string) *Connection {
+	return &Connection{
+		dns:   dns,
+		addr:  safeAddr(dns),
+		state: StateDisconnected,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Connect 建立连接并启动守护协程, 返回首次连接的结果
+// 首次连接失败时守护协程仍会在后台继续重连, 直到调用 Close
+func (c *Connection) Connect() error {
+	if isMemoryDNS(c.dns) {
+		// 内存broker不需要建立连接, 打开管道时再查找broker
+		c.mu.Lock()
+		close(c.ready)
+		c.mu.Unlock()
+		c.setState(StateConnected, nil, 0)
+		return nil
+	}
+	first := make(chan error, 1)
+	go c.supervise(first)
+	return <-first
+}
+
+// Start 启动守护协程后立即返回, 不等待首次连接, 通过 WaitReady 等待连接可用
+func (c *Connection) Start() {
+	if isMemoryDNS(c.dns) {
+		_ = c.Connect()
+		return
+	}
+	go c.supervise(nil)
+}
+
+// supervise 守护连接, 监听 NotifyClose 并在断开后重连
+func (c *Connection) supervise(first chan<- error) {
+	attempt := 0
+	state := StateConnecting
+	for {
+		c.setState(state, nil, attempt)
+		conn, err := c.dial()
+		if first != nil {
+			first <- err
+			first = nil
+		}
+		if err != nil {
+			attempt++
+			c.setState(StateReconnecting, err, attempt)
+			log.Printf("[rabbitmq] 连接 %s 失败(第%d次): %s \n", c.addr, attempt, err)
+			if !c.sleep(backoff(attempt)) {
+				return
+			}
+			state = StateReconnecting
+			continue
+		}
+
+		closes := conn.NotifyClose(make(chan *amqp.Error, 1))
+		c.mu.Lock()
+		c.conn = conn
+		close(c.ready)
+		c.mu.Unlock()
+		attempt = 0
+		c.setState(StateConnected, nil, 0)
+
+		select {
+		case <-c.done:
+			_ = conn.Close()
+			return
+		case reason, ok := <-closes:
+			if c.IsClosed() {
+				return
+			}
+			c.mu.Lock()
+			c.conn = nil
+			c.ready = make(chan struct{})
+			c.mu.Unlock()
+			if !ok {
+				// 正常关闭, 但并非由 Close 触发, 依然需要重连
+				reason = amqp.ErrClosed
+			}
+			c.setState(StateDisconnected, reason, 0)
+			log.Printf("[rabbitmq] 连接 %s 断开: %v \n", c.addr, reason)
+		}
+
+		attempt = 1
+		state = StateReconnecting
+		if !c.sleep(backoff(attempt)) {
+			return
+		}
+	}
+}
+
+// dial 建立底层连接, 结构化配置按顺序尝试各节点
+// 每次都重新读取注册的配置, 重新注册后重连即使用新的节点与账号
+func (c *Connection) dial() (*amqp.Connection, error) {
+	if cfg := lookupConnConfig(c.dns); cfg != nil {
+		return cfg.dial()
+	}
+	return amqp.Dial(c.dns)
+}
+
+// sleep 等待指定时长, 连接被关闭时返回false
+func (c *Connection) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-c.done:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// setState 更新状态并广播事件
+func (c *Connection) setState(state ConnState, err error, attempt int) {
+	event := StateEvent{Addr: c.addr, State: state, Err: err, Attempt: attempt, Time: time.Now()}
+
+	c.mu.Lock()
+	c.state = state
+	listeners := append([]chan StateEvent{}, c.listeners...)
+	c.mu.Unlock()
+
+	stateMu.RLock()
+	listeners = append(listeners, stateListeners...)
+	stateMu.RUnlock()
+
+	for _, l := range listeners {
+		select {
+		case l <- event:
+		default:
+		}
+	}
+}
+
+// NotifyState 注册当前连接的状态监听, 建议传入带缓冲的chan
+func (c *Connection) NotifyState(receiver chan StateEvent) chan StateEvent {
+	c.mu.Lock()
+	c.listeners = append(c.listeners, receiver)
+	c.mu.Unlock()
+	return receiver
+}
+
+// State 当前连接状态
+func (c *Connection) State() ConnState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state
+}
+
+// Conn 当前底层连接, 未连接时返回nil
+func (c *Connection) Conn() *amqp.Connection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+// Channel 在当前连接上打开管道
+func (c *Connection) Channel() (*amqp.Channel, error) {
+	if c.IsClosed() {
+		return nil, ErrConnectionClosed
+	}
+	conn := c.Conn()
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+	return conn.Channel()
+}
+
+// channel 打开内部使用的管道, 内存broker地址返回内存管道
+func (c *Connection) channel() (channel, error) {
+	if !isMemoryDNS(c.dns) {
+		ch, err := c.Channel()
+		if err != nil {
+			return nil, err
+		}
+		return ch, nil
+	}
+	if c.IsClosed() {
+		return nil, ErrConnectionClosed
+	}
+	b := lookupMemoryBroker(c.dns)
+	if b == nil {
+		return nil, ErrNotConnected
+	}
+	return b.channel()
+}
+
+// WaitReady 阻塞直到连接可用, 连接关闭或ctx结束时返回错误
+func (c *Connection) WaitReady(ctx context.Context) error {
+	c.mu.RLock()
+	ready := c.ready
+	c.mu.RUnlock()
+	select {
+	case <-ready:
+		return nil
+	case <-c.done:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsClosed 是否已被主动关闭
+func (c *Connection) IsClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 关闭连接并停止重连
+func (c *Connection) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		conn := c.conn
+		c.conn = nil
+		c.mu.Unlock()
+		if conn != nil {
+			err = conn.Close()
+		}
+		c.setState(StateClosed, nil, 0)
+	})
+	return
+}
+
+// backoff 指数退避并加入随机抖动
+func backoff(attempt int) time.Duration {
+	d := MinReconnectDelay
+	for i := 1; i < attempt && d < MaxReconnectDelay; i++ {
+		d *= 2
+	}
+	if d > MaxReconnectDelay {
+		d = MaxReconnectDelay
+	}
+	// 抖动范围 [d/2, d)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// safeAddr 去掉账号密码后的连接地址, 用于日志与事件
+func safeAddr(dns string) string {
+	if isMemoryDNS(dns) {
+		return dns
+	}
+	if cfg := lookupConnConfig(dns); cfg != nil {
+		return cfg.addr()
+	}
+	uri, err := amqp.ParseURI(dns)
+	if err != nil {
+		return "invalid-uri"
+	}
+	return fmt.Sprintf("%s://%s:%d/%s", uri.Scheme, uri.Host, uri.Port, uri.Vhost)
+}
@@ -0,0 +1,161 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	utilredis "github.com/biwankaifa/go-util/redis"
+	goredis "github.com/go-redis/redis/v8"
+)
+
+// ErrDuplicateInProgress 相同消息正在被其他消费者处理, 以 Defer 包装返回, 延迟到处理中记录过期后重新判断, 不计入重试次数
+var ErrDuplicateInProgress = errors.New("rabbitmq: duplicate message in progress")
+
+// 去重记录的值, 处理中的记录带有本次处理的token
+const (
+	dedupDone       = "done"
+	dedupProcessing = "processing:"
+)
+
+// dedupRelease 只删除本次处理写入的记录
+var dedupRelease = goredis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// KeyFunc 从消息中提取去重key, 返回空字符串时不去重
+type KeyFunc func(d *Delivery) string
+
+// MessageIDKey 使用消息ID去重, Message/Envelope/发件箱发布的消息均带有ID
+func MessageIDKey(d *Delivery) string {
+	return d.MessageId
+}
+
+// HeaderKey 使用指定header的值去重, 如业务单号
+func HeaderKey(name string) KeyFunc {
+	return func(d *Delivery) string {
+		v, _ := d.Headers[name].(string)
+		return v
+	}
+}
+
+// DedupOptions 去重配置
+type DedupOptions struct {
+	Client        *goredis.Client // redis客户端, 默认为 redis.Get()
+	Prefix        string          // key前缀, 默认 mq:dedup:
+	Key           KeyFunc         // 去重key, 默认 MessageIDKey
+	TTL           time.Duration   // 已处理记录的保留时长, 需大于消息可能重复投递的时间窗口, 默认24小时
+	ProcessingTTL time.Duration   // 处理中记录的有效期, 需大于处理函数的最长执行时间(如 Timeout 中间件的时长), 进程崩溃后过期即可重新处理, 默认5分钟
+	FailOpen      bool            // redis不可用时仍然处理消息, 默认返回错误进入重试
+}
+
+// Validate 校验配置, 有效期不能为负数
+// 处理中的重复消息以 Defer 延迟, 不消耗重试次数, ProcessingTTL 不受重试策略总时长的限制
+func (opts DedupOptions) Validate() error {
+	if opts.TTL < 0 || opts.ProcessingTTL < 0 {
+		return errors.New("rabbitmq: dedup ttl must not be negative")
+	}
+	return nil
+}
+
+// dedupDeferSteps 处理中记录的剩余有效期按 ProcessingTTL 的十分之一向上取整, 限制延迟队列的数量
+const dedupDeferSteps = 10
+
+// deferDelay 等待处理中记录过期的延迟
+func deferDelay(remaining, processingTTL time.Duration) time.Duration {
+	step := processingTTL / dedupDeferSteps
+	if step < time.Second {
+		step = time.Second
+	}
+	if remaining <= 0 {
+		return step
+	}
+	return (remaining + step - 1) / step * step
+}
+
+// Dedup 基于redis的幂等消费中间件, 相同队列中已处理成功的消息直接确认, 不再调用处理函数
+//
+// 处理前写入处理中记录(SET NX), 成功后改为已处理记录, 失败时删除记录以便重试
+// 记录已存在时: 已处理则跳过; 处理中则延迟到记录过期后重新投递(Defer, 不计入重试次数),
+// 若持有记录的消费者崩溃, 记录在 ProcessingTTL 后过期, 重新投递时会重新处理
+// 配置不合法时返回错误, 见 DedupOptions.Validate
+func Dedup(opts DedupOptions) (Middleware, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = "mq:dedup:"
+	}
+	if opts.Key == nil {
+		opts.Key = MessageIDKey
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	if opts.ProcessingTTL == 0 {
+		opts.ProcessingTTL = 5 * time.Minute
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, d *Delivery) error {
+			id := opts.Key(d)
+			if id == "" {
+				return next(ctx, d)
+			}
+			client := opts.Client
+			if client == nil {
+				client = utilredis.Get()
+			}
+			key := opts.Prefix + d.Queue + ":" + id
+			token := dedupProcessing + NewMessageID()
+
+			// redis操作不受处理超时影响
+			rctx := detach(ctx)
+			ok, err := client.SetNX(rctx, key, token, opts.ProcessingTTL).Result()
+			if err != nil {
+				if opts.FailOpen {
+					log.Printf("[%s#%d] 去重记录写入失败, 继续处理 :%s \n", d.Queue, d.Worker, err)
+					return next(ctx, d)
+				}
+				return err
+			}
+			if !ok {
+				v, err := client.Get(rctx, key).Result()
+				switch {
+				case err == goredis.Nil:
+					// 记录刚好过期, 稍后重新判断
+					return Defer(ErrDuplicateInProgress, deferDelay(0, opts.ProcessingTTL))
+				case err != nil:
+					if opts.FailOpen {
+						return next(ctx, d)
+					}
+					return err
+				case v == dedupDone:
+					log.Printf("[%s#%d] 消息 %s 已处理, 跳过 \n", d.Queue, d.Worker, id)
+					return nil
+				}
+				// 其他消费者正在处理, 等待记录过期后再判断, 期间不消耗重试次数
+				remaining, err := client.PTTL(rctx, key).Result()
+				if err != nil {
+					remaining = opts.ProcessingTTL
+				}
+				return Defer(ErrDuplicateInProgress, deferDelay(remaining, opts.ProcessingTTL))
+			}
+
+			if err = next(ctx, d); err != nil {
+				if relErr := dedupRelease.Run(rctx, client, []string{key}, token).Err(); relErr != nil {
+					log.Printf("[%s#%d] 去重记录删除失败 :%s \n", d.Queue, d.Worker, relErr)
+				}
+				return err
+			}
+			if setErr := client.Set(rctx, key, dedupDone, opts.TTL).Err(); setErr != nil {
+				// 消息已处理成功, 仍然确认, 处理中记录过期前的重复投递会进入重试
+				log.Printf("[%s#%d] 去重记录更新失败 :%s \n", d.Queue, d.Worker, setErr)
+			}
+			return nil
+		}
+	}, nil
+}
@@ -0,0 +1,46 @@
+package rabbitmq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    DedupOptions
+		wantErr bool
+	}{
+		{name: "default", opts: DedupOptions{}},
+		{name: "longer than retry budget", opts: DedupOptions{ProcessingTTL: 10 * time.Minute}},
+		{name: "negative", opts: DedupOptions{ProcessingTTL: -time.Second}, wantErr: true},
+		{name: "negative ttl", opts: DedupOptions{TTL: -time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := Dedup(DedupOptions{ProcessingTTL: 10 * time.Minute}); err != nil {
+		t.Fatalf("Dedup with long processing ttl: %v", err)
+	}
+}
+
+func TestDeferDelay(t *testing.T) {
+	tests := []struct {
+		remaining, processingTTL, want time.Duration
+	}{
+		{remaining: 0, processingTTL: time.Minute, want: 6 * time.Second},
+		{remaining: 7 * time.Second, processingTTL: time.Minute, want: 12 * time.Second},
+		{remaining: 12 * time.Second, processingTTL: time.Minute, want: 12 * time.Second},
+		{remaining: 1500 * time.Millisecond, processingTTL: 5 * time.Second, want: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := deferDelay(tt.remaining, tt.processingTTL); got != tt.want {
+			t.Errorf("deferDelay(%s, %s) = %s, want %s", tt.remaining, tt.processingTTL, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DelayStrategy 延迟消息的实现方式
+type DelayStrategy int
+
+const (
+	// DelayAuto 首次发送时探测 x-delayed-message 插件, 可用时使用插件, 否则使用TTL队列
+	DelayAuto DelayStrategy = iota
+	// DelayPlugin 使用 rabbitmq_delayed_message_exchange 插件
+	DelayPlugin
+	// DelayTTL 使用 DelayTiers 对应的TTL队列, 过期后经死信投递到目标队列
+	DelayTTL
+)
+
+// DefaultDelayStrategy SendDelayed/SendAt 使用的实现方式
+var DefaultDelayStrategy = DelayAuto
+
+// DelayTiers TTL队列方式使用的延迟档位, 从小到大排列, 每个队列最多创建 len(DelayTiers) 个延迟队列
+// 消息先进入不超过剩余延迟的最大档位, 到期后消费者按 x-delay-until 将剩余的延迟投递到下一个档位, 直到到期
+// 投递误差小于最小档位
+var DelayTiers = []time.Duration{
+	time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+	time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// 插件方式相关的常量
+const (
+	delayedExchangeType = "x-delayed-message"
+	headerDelay         = "x-delay"
+	headerDelayUntil    = "x-delay-until"
+	headerDelayTTL      = "x-delay-ttl" // 经TTL档位队列延迟的消息, 消费时检查是否已到期
+	delayProbeExchange  = "go-util.delayed-probe"
+	maxPluginDelay      = time.Duration(math.MaxUint32) * time.Millisecond
+)
+
+// ErrDelayTooLong 延迟时间超过插件支持的上限(约49天)
+var ErrDelayTooLong = errors.New("rabbitmq: delay exceeds x-delayed-message limit")
+
+// SendDelayed 发送延迟消息, 在 d 之后投递到队列, 等待broker确认, 超时时间为 PublishTimeout
+// d 小于等于0时立即投递
+func SendDelayed(queueExchange QueueExchange, msg string, d time.Duration, opts ...PublishOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	return SendDelayedCtx(ctx, queueExchange, msg, d, opts...)
+}
+
+// SendDelayedCtx 发送延迟消息, broker确认后返回
+func SendDelayedCtx(ctx context.Context, queueExchange QueueExchange, msg string, d time.Duration, opts ...PublishOption) error {
+	return getPublisher(queueExchange.Dns).PublishDelayed(ctx, queueExchange, msg, d, opts...)
+}
+
+// SendAt 发送定时消息, 在 at 时刻投递到队列, at 已经过去时立即投递
+func SendAt(queueExchange QueueExchange, msg string, at time.Time, opts ...PublishOption) error {
+	return SendDelayed(queueExchange, msg, time.Until(at), opts...)
+}
+
+// SendMessageDelayed 发送延迟的类型化消息
+func SendMessageDelayed(ctx context.Context, queueExchange QueueExchange, m Message, d time.Duration, opts ...PublishOption) error {
+	return getPublisher(queueExchange.Dns).PublishMessageDelayed(ctx, queueExchange, m, d, opts...)
+}
+
+// PublishDelayed 发布延迟消息, broker确认后返回
+func (p *Publisher) PublishDelayed(ctx context.Context, queueExchange QueueExchange, msg string, d time.Duration, opts ...PublishOption) error {
+	return p.publishDelayed(ctx, queueExchange, newPublishing(ContentTypeText, []byte(msg), opts...), d)
+}
+
+// PublishMessageDelayed 编码并发布延迟的类型化消息, broker确认后返回
+func (p *Publisher) PublishMessageDelayed(ctx context.Context, queueExchange QueueExchange, m Message, d time.Duration, opts ...PublishOption) error {
+	msg, err := m.publishing(opts...)
+	if err != nil {
+		return err
+	}
+	return p.publishDelayed(ctx, queueExchange, msg, d)
+}
+
+// publishDelayed 按 DefaultDelayStrategy 选择插件交换机或TTL队列发布
+// 自动探测无法完成时返回错误, 不会退回TTL队列, 避免同一连接混用两种方式
+// 开启本地缓存时, 连接不可用或探测无法完成的消息写入缓存, 重新发布时再按剩余的延迟选择方式
+func (p *Publisher) publishDelayed(ctx context.Context, queueExchange QueueExchange, msg amqp.Publishing, d time.Duration) error {
+	if d <= 0 {
+		return p.deliver(ctx, queueTopology(queueExchange), msg)
+	}
+	msg.Headers = copyTable(msg.Headers)
+	msg.Headers[headerDelayUntil] = time.Now().Add(d)
+
+	s := p.getSpool()
+	if s != nil && (s.Pending() > 0 || p.conn.State() != StateConnected) {
+		return s.append(ctx, queueTopology(queueExchange), msg, true)
+	}
+	t, err := p.delayTarget(ctx, queueExchange, msg, d)
+	if err != nil {
+		if s != nil && spoolable(err) {
+			log.Printf("[spool] 延迟方式未确定, 写入本地缓存 :%s \n", err)
+			return s.append(ctx, queueTopology(queueExchange), msg, true)
+		}
+		return err
+	}
+	return p.deliver(ctx, t, msg)
+}
+
+// delayTarget 选择延迟方式, 写入对应的headers并返回发布的拓扑, msg.Headers 需为副本
+func (p *Publisher) delayTarget(ctx context.Context, queueExchange QueueExchange, msg amqp.Publishing, d time.Duration) (topology, error) {
+	usePlugin := DefaultDelayStrategy == DelayPlugin
+	if DefaultDelayStrategy == DelayAuto {
+		available, err := p.delayPluginAvailable(ctx)
+		if err != nil {
+			exchange, key := delayedExchangeTopology(queueExchange).target()
+			return topology{}, &PublishError{Kind: err, Exchange: exchange, RoutingKey: key}
+		}
+		usePlugin = available
+	}
+	if usePlugin {
+		if d > maxPluginDelay {
+			return topology{}, ErrDelayTooLong
+		}
+		msg.Headers[headerDelay] = d.Milliseconds()
+		return delayedExchangeTopology(queueExchange), nil
+	}
+	// 消息过期时目标队列需已存在, 否则会被丢弃
+	if err := p.ensure(ctx, queueTopology(queueExchange)); err != nil {
+		return topology{}, err
+	}
+	msg.Headers[headerDelayTTL] = true
+	return delayTopology(queueExchange, "delay", delayTier(d)), nil
+}
+
+// delayTier 不超过 d 的最大档位, d 小于最小档位时使用最小档位
+func delayTier(d time.Duration) time.Duration {
+	if len(DelayTiers) == 0 {
+		return d
+	}
+	tier := DelayTiers[0]
+	for _, t := range DelayTiers {
+		if t > d {
+			break
+		}
+		tier = t
+	}
+	return tier
+}
+
+// delayRemaining 经TTL档位队列延迟的消息距离 x-delay-until 的剩余时间, 不足最小档位时视为已到期返回0
+func delayRemaining(msg amqp.Delivery) time.Duration {
+	if ttl, _ := msg.Headers[headerDelayTTL].(bool); !ttl || len(DelayTiers) == 0 {
+		return 0
+	}
+	until, ok := msg.Headers[headerDelayUntil].(time.Time)
+	if !ok {
+		return 0
+	}
+	if remaining := time.Until(until); remaining >= DelayTiers[0] {
+		return remaining
+	}
+	return 0
+}
+
+// redelay 未到期的延迟消息投递到剩余时间对应的档位队列, 成功后确认, 失败时重新入队
+func (mq *RabbitMQ) redelay(msg amqp.Delivery, remaining time.Duration, routineNum int) {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	t := delayTopology(mq.options(), "delay", delayTier(remaining))
+	if err := getPublisher(mq.options().Dns).deliver(ctx, t, republishing(msg, retryHeaders(msg, 0, nil, false))); err != nil {
+		log.Printf("[%s#%d] 延迟消息重新投递失败 :%s \n", mq.QueueName, routineNum, err)
+		mq.requeue(msg, routineNum)
+		return
+	}
+	if err := msg.Ack(false); err != nil {
+		log.Printf("[%s#%d] 延迟消息确认失败 :%s \n", mq.QueueName, routineNum, err)
+	}
+}
+
+// DelayedExchangeName 插件方式下队列对应的延迟交换机名称
+func DelayedExchangeName(queueExchange QueueExchange) string {
+	if queueExchange.ExName != "" {
+		return queueExchange.ExName + ".delayed"
+	}
+	return queueExchange.QuName + ".delayed"
+}
+
+// delayedExchangeTopology 插件方式的拓扑, 延迟交换机与原交换机类型相同, 只绑定当前队列
+func delayedExchangeTopology(queueExchange QueueExchange) topology {
+	t := queueTopology(queueExchange)
+	kind := queueExchange.ExType
+	if kind == "" || queueExchange.ExName == "" {
+		kind = amqp.ExchangeDirect
+	}
+	if queueExchange.ExName == "" || queueExchange.RtKey == "" {
+		t.routingKey = queueExchange.QuName
+	}
+	t.exchange = DelayedExchangeName(queueExchange)
+	t.exchangeType = delayedExchangeType
+	t.exchangeArgs = amqp.Table{"x-delayed-type": kind}
+	// 延迟交换机不受 SkipDeclare 影响, 由发布方维护
+	t.skip = false
+	return t
+}
+
+// delayProbe 一次插件探测, done 关闭后 plugin/err 为探测结果
+type delayProbe struct {
+	done   chan struct{}
+	plugin bool
+	err    error
+}
+
+// delayPluginAvailable 探测broker是否启用了 x-delayed-message 插件, 结果缓存在生产者上, 同一连接始终使用同一种方式
+// 探测在后台进行, 并发的调用共用同一次探测, 各自最多等待到ctx结束
+// 连接失败等无法确定结果的情况返回错误且不缓存, 下次发送重新探测
+func (p *Publisher) delayPluginAvailable(ctx context.Context) (bool, error) {
+	p.delayMu.Lock()
+	if p.delayProbed {
+		p.delayMu.Unlock()
+		return p.delayPlugin, nil
+	}
+	probe := p.delayProbe
+	if probe == nil {
+		probe = &delayProbe{done: make(chan struct{})}
+		p.delayProbe = probe
+		go p.probeDelayPlugin(probe)
+	}
+	p.delayMu.Unlock()
+
+	select {
+	case <-probe.done:
+		return probe.plugin, probe.err
+	case <-ctx.Done():
+		return false, publishTimeout(ctx)
+	}
+}
+
+// probeDelayPlugin 执行一次探测, 最长 PublishTimeout
+// 声明未知类型的交换机会导致broker关闭连接, 因此使用独立的临时连接探测
+func (p *Publisher) probeDelayPlugin(probe *delayProbe) {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	probe.plugin, probe.err = p.probe(ctx)
+
+	p.delayMu.Lock()
+	if probe.err == nil {
+		p.delayProbed, p.delayPlugin = true, probe.plugin
+	}
+	p.delayProbe = nil
+	p.delayMu.Unlock()
+	close(probe.done)
+}
+
+// probe 在临时连接上声明 x-delayed-message 类型的交换机
+func (p *Publisher) probe(ctx context.Context) (bool, error) {
+	conn := NewConnection(p.conn.dns)
+	defer func() {
+		_ = conn.Close()
+	}()
+	conn.Start()
+	if err := conn.WaitReady(ctx); err != nil {
+		if ctx.Err() != nil {
+			return false, publishTimeout(ctx)
+		}
+		return false, fmt.Errorf("rabbitmq: probe x-delayed-message: %w", err)
+	}
+	ch, err := conn.channel()
+	if err != nil {
+		return false, fmt.Errorf("rabbitmq: probe x-delayed-message: %w", err)
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	err = ch.ExchangeDeclare(delayProbeExchange, delayedExchangeType, false, true, false, false, amqp.Table{"x-delayed-type": amqp.ExchangeDirect})
+	var amqpErr *amqp.Error
+	switch {
+	case err == nil:
+		_ = ch.ExchangeDelete(delayProbeExchange, false, false)
+		return true, nil
+	case errors.As(err, &amqpErr) && amqpErr.Code == amqp.CommandInvalid:
+		log.Printf("[rabbitmq] %s 未启用 x-delayed-message 插件, 延迟消息使用TTL队列 \n", safeAddr(p.conn.dns))
+		return false, nil
+	default:
+		return false, fmt.Errorf("rabbitmq: probe x-delayed-message: %w", err)
+	}
+}
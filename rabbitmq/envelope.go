@@ -0,0 +1,234 @@
+package rabbitmq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// headerSchemaVersion 消息结构版本号
+const headerSchemaVersion = "x-schema-version"
+
+// Envelope 标准消息信封, 元数据保存在AMQP属性中, Payload 为按 ContentType 编码后的消息体
+type Envelope struct {
+	ID          string     // 消息ID, 对应 MessageId
+	Type        string     // 消息类型, 对应 Type
+	Version     int        // 结构版本, 对应 header x-schema-version
+	ProducedAt  time.Time  // 生产时间, 对应 Timestamp
+	ContentType string     // 编码方式
+	Headers     amqp.Table // 原始headers
+	Payload     []byte     // 编码后的消息体
+}
+
+// EnvelopeFromDelivery 从投递的消息中解析信封
+func EnvelopeFromDelivery(d amqp.Delivery) *Envelope {
+	return &Envelope{
+		ID:          d.MessageId,
+		Type:        d.Type,
+		Version:     int(toInt64(d.Headers[headerSchemaVersion])),
+		ProducedAt:  d.Timestamp,
+		ContentType: d.ContentType,
+		Headers:     d.Headers,
+		Payload:     d.Body,
+	}
+}
+
+// Decode 按 ContentType 将消息体解码到 v
+func (e *Envelope) Decode(v interface{}) error {
+	c, err := CodecFor(e.ContentType)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(e.Payload, v)
+}
+
+// Message 待发布的类型化消息
+type Message struct {
+	ID          string      // 消息ID, 为空时自动生成
+	Type        string      // 消息类型, 为空时使用 Payload 的类型名
+	Version     int         // 结构版本
+	ContentType string      // 编码方式, 为空时使用 DefaultContentType
+	Payload     interface{} // 消息内容
+}
+
+// publishing 编码为AMQP消息
+func (m Message) publishing(opts ...PublishOption) (amqp.Publishing, error) {
+	contentType := m.ContentType
+	if contentType == "" {
+		contentType = DefaultContentType
+	}
+	c, err := CodecFor(contentType)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	body, err := c.Marshal(m.Payload)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	id := m.ID
+	if id == "" {
+		id = NewMessageID()
+	}
+	msgType := m.Type
+	if msgType == "" {
+		msgType = typeName(reflect.TypeOf(m.Payload))
+	}
+	msg := amqp.Publishing{
+		ContentType:  contentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    id,
+		Type:         msgType,
+		Timestamp:    time.Now(),
+		Headers:      amqp.Table{headerSchemaVersion: int32(m.Version)},
+		Body:         body,
+	}
+	applyOptions(&msg, opts)
+	return msg, nil
+}
+
+// NewMessageID 生成随机的消息ID(UUID v4格式)
+func NewMessageID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// typeName 类型名称, 指针取其元素类型
+func typeName(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// PublishMessage 编码并发布类型化消息, broker确认后返回
+func (p *Publisher) PublishMessage(ctx context.Context, queueExchange QueueExchange, m Message, opts ...PublishOption) error {
+	msg, err := m.publishing(opts...)
+	if err != nil {
+		return err
+	}
+	return p.deliver(ctx, queueTopology(queueExchange), msg)
+}
+
+// SendMessage 编码并发布类型化消息, broker确认后返回
+func SendMessage(ctx context.Context, queueExchange QueueExchange, m Message, opts ...PublishOption) error {
+	return getPublisher(queueExchange.Dns).PublishMessage(ctx, queueExchange, m, opts...)
+}
+
+var (
+	ctxType      = reflect.TypeOf((*context.Context)(nil)).Elem()
+	envelopeType = reflect.TypeOf((*Envelope)(nil))
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// TypedReceiver 类型化消费者, 先按 content-type 将消息解码为结构体再调用处理函数
+type TypedReceiver struct {
+	queueExchange QueueExchange
+	fn            reflect.Value
+	arg           reflect.Type // 处理函数第三个参数的类型
+	contentType   string
+
+	// OnFail 重试次数用尽后的回调, 可选
+	OnFail func(err error, body []byte) error
+}
+
+// NewTypedReceiver 创建类型化消费者
+// handler 签名须为 func(context.Context, *Envelope, T) error, T 可以是结构体或结构体指针
+func NewTypedReceiver(queueExchange QueueExchange, handler interface{}) (*TypedReceiver, error) {
+	fn := reflect.ValueOf(handler)
+	t := fn.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 3 || t.NumOut() != 1 ||
+		t.In(0) != ctxType || t.In(1) != envelopeType || t.Out(0) != errorType {
+		return nil, fmt.Errorf("rabbitmq: handler must be func(context.Context, *Envelope, T) error, got %s", t)
+	}
+	return &TypedReceiver{
+		queueExchange: queueExchange,
+		fn:            fn,
+		arg:           t.In(2),
+	}, nil
+}
+
+// SetContentType 设置 Send 使用的编码方式
+func (r *TypedReceiver) SetContentType(contentType string) *TypedReceiver {
+	r.contentType = contentType
+	return r
+}
+
+// Options Receiver接口实现
+func (r *TypedReceiver) Options() QueueExchange {
+	return r.queueExchange
+}
+
+// ConsumeDelivery DeliveryReceiver接口实现, 解码后调用处理函数
+func (r *TypedReceiver) ConsumeDelivery(ctx context.Context, d amqp.Delivery) error {
+	return r.invoke(ctx, EnvelopeFromDelivery(d))
+}
+
+// Consumer Receiver接口实现, 没有消息属性时按 DefaultContentType 解码
+func (r *TypedReceiver) Consumer(body []byte) error {
+	return r.invoke(context.Background(), &Envelope{ContentType: DefaultContentType, Payload: body})
+}
+
+// invoke 解码并调用处理函数
+// 未知的编码方式与格式错误的消息重试也无法成功, 以 Permanent 返回直接转入停放队列
+func (r *TypedReceiver) invoke(ctx context.Context, env *Envelope) error {
+	var v reflect.Value
+	if r.arg.Kind() == reflect.Ptr {
+		v = reflect.New(r.arg.Elem())
+		if err := env.Decode(v.Interface()); err != nil {
+			return Permanent(fmt.Errorf("rabbitmq: decode %s: %w", r.arg, err))
+		}
+	} else {
+		p := reflect.New(r.arg)
+		if err := env.Decode(p.Interface()); err != nil {
+			return Permanent(fmt.Errorf("rabbitmq: decode %s: %w", r.arg, err))
+		}
+		v = p.Elem()
+	}
+	out := r.fn.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(env), v})
+	if err, _ := out[0].Interface().(error); err != nil {
+		return err
+	}
+	return nil
+}
+
+// FailAction Receiver接口实现
+func (r *TypedReceiver) FailAction(err error, body []byte) error {
+	if r.OnFail != nil {
+		return r.OnFail(err, body)
+	}
+	return nil
+}
+
+// Send Receiver接口实现, 将每个参数作为一条类型化消息发布到当前队列, 部分失败时返回 MultiError
+func (r *TypedReceiver) Send(payloads ...interface{}) error {
+	var errs MultiError
+	for _, payload := range payloads {
+		ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+		err := SendMessage(ctx, r.queueExchange, Message{ContentType: r.contentType, Payload: payload})
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Recv Receiver接口实现
+func (r *TypedReceiver) Recv(runNums int) {
+	Recv(r.queueExchange, r, runNums)
+}
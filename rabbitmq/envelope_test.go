@@ -0,0 +1,71 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+type testOrder struct {
+	ID int `json:"id"`
+}
+
+func TestTypedReceiverDecodeErrorIsPermanent(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{name: "malformed json", contentType: ContentTypeJSON, body: "{"},
+		{name: "unknown content type", contentType: "application/x-unknown", body: "{}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			qe := QueueExchange{QuName: "orders", Dns: b.DNS()}
+			var calls int32
+			r, err := NewTypedReceiver(qe, func(ctx context.Context, env *Envelope, o testOrder) error {
+				atomic.AddInt32(&calls, 1)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_ = RecvCtx(ctx, qe, r, 1)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			waitFor(t, "queue declared", func() bool { return len(b.Queues()) > 0 })
+			if err := SendTo(ctx, b.DNS(), "", "orders", []byte(tt.body), WithContentType(tt.contentType)); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "parking", func() bool {
+				ready, _ := b.QueueDepth(ParkingQueueName(qe))
+				return ready == 1
+			})
+			if n := atomic.LoadInt32(&calls); n != 0 {
+				t.Errorf("handler called %d times", n)
+			}
+			if got := retryCount(b.Messages(ParkingQueueName(qe))[0]); got != 0 {
+				t.Errorf("parked after %d retries, want 0", got)
+			}
+		})
+	}
+
+	// 仍可判断原始的解码错误
+	r, _ := NewTypedReceiver(QueueExchange{}, func(context.Context, *Envelope, *testOrder) error { return nil })
+	err := r.invoke(context.Background(), &Envelope{ContentType: ContentTypeJSON, Payload: []byte(`{"id":"x"}`)})
+	var typeErr *json.UnmarshalTypeError
+	if !errors.Is(err, ErrPermanent) || !errors.As(err, &typeErr) {
+		t.Fatalf("err = %v", err)
+	}
+}
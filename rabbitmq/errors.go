@@ -0,0 +1,189 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 处理函数可返回以下错误控制失败消息的去向, 支持被 fmt.Errorf("%w") 再次包装
+//
+//	return rabbitmq.Permanent(err)                  // 不再重试, 直接停放并调用 FailAction
+//	return rabbitmq.RetryAfter(err, 5*time.Minute)  // 按指定延迟重试, 仍计入重试次数
+//	return rabbitmq.Defer(err, time.Minute)         // 按指定延迟重新投递, 不计入重试次数
+//	return rabbitmq.Requeue(err)                    // 立即放回队列, 不计入重试次数
+var (
+	// ErrPermanent 永久失败, 可用 errors.Is 判断
+	ErrPermanent = errors.New("rabbitmq: permanent failure")
+	// ErrRequeue 立即重新入队, 可用 errors.Is 判断
+	ErrRequeue = errors.New("rabbitmq: requeue")
+)
+
+// PermanentError 永久失败, 如消息格式错误, 重试也不会成功
+type PermanentError struct {
+	Err error
+}
+
+// Permanent 包装为永久失败
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// Error error接口实现
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrPermanent, e.Err)
+}
+
+// Unwrap 支持 errors.Is/As 判断原始错误
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Is 支持 errors.Is(err, ErrPermanent)
+func (e *PermanentError) Is(target error) bool {
+	return target == ErrPermanent
+}
+
+// RetryAfterError 按指定延迟重试
+type RetryAfterError struct {
+	Err   error
+	Delay time.Duration
+}
+
+// RetryAfter 包装为按指定延迟重试, 延迟队列按 Delay 创建, 与 RetryPolicy.Backoff 的档位互不影响
+func RetryAfter(err error, d time.Duration) error {
+	return &RetryAfterError{Err: err, Delay: d}
+}
+
+// Error error接口实现
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.Err, e.Delay)
+}
+
+// Unwrap 支持 errors.Is/As 判断原始错误
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// DeferError 按指定延迟重新投递, 不计入重试次数
+type DeferError struct {
+	Err   error
+	Delay time.Duration
+}
+
+// Defer 包装为延迟重新投递, 不计入重试次数也不会转入停放队列, 适用于等待其他消费者完成等非失败的情况
+// 持续返回该错误会导致消息被反复投递, 需由处理函数自行限制
+func Defer(err error, d time.Duration) error {
+	return &DeferError{Err: err, Delay: d}
+}
+
+// Error error接口实现
+func (e *DeferError) Error() string {
+	return fmt.Sprintf("%v (deferred %s)", e.Err, e.Delay)
+}
+
+// Unwrap 支持 errors.Is/As 判断原始错误
+func (e *DeferError) Unwrap() error {
+	return e.Err
+}
+
+// RequeueError 立即放回队列重新投递
+type RequeueError struct {
+	Err error
+}
+
+// Requeue 包装为立即重新入队, 适用于短暂的资源争用, 不计入重试次数
+// 持续返回该错误会导致消息被反复投递, 需由处理函数自行限制
+func Requeue(err error) error {
+	return &RequeueError{Err: err}
+}
+
+// Error error接口实现
+func (e *RequeueError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrRequeue, e.Err)
+}
+
+// Unwrap 支持 errors.Is/As 判断原始错误
+func (e *RequeueError) Unwrap() error {
+	return e.Err
+}
+
+// Is 支持 errors.Is(err, ErrRequeue)
+func (e *RequeueError) Is(target error) bool {
+	return target == ErrRequeue
+}
+
+// failure 失败消息的去向
+type failure int
+
+const (
+	failureRetry failure = iota
+	failurePark
+	failureRequeue
+	failureDefer
+)
+
+// classify 按错误类型与已重试次数决定失败消息的去向与重试延迟
+func classify(err error, retryNums int32, policy RetryPolicy) (failure, time.Duration) {
+	var requeue *RequeueError
+	if errors.As(err, &requeue) {
+		return failureRequeue, 0
+	}
+	var deferred *DeferError
+	if errors.As(err, &deferred) && deferred.Delay > 0 {
+		return failureDefer, deferred.Delay
+	}
+	var permanent *PermanentError
+	if errors.As(err, &permanent) {
+		return failurePark, 0
+	}
+	if int(retryNums) >= policy.MaxAttempts {
+		return failurePark, 0
+	}
+	var retryAfter *RetryAfterError
+	if errors.As(err, &retryAfter) && retryAfter.Delay > 0 {
+		return failureRetry, retryAfter.Delay
+	}
+	return failureRetry, policy.delay(retryNums)
+}
+
+// MultiError 多个操作失败, errors.Is/errors.As 会逐个匹配其中的错误
+type MultiError []error
+
+// Error error接口实现
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("rabbitmq: %d errors: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Unwrap 返回第一个错误
+func (e MultiError) Unwrap() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e[0]
+}
+
+// Is 任一错误匹配即可
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As 取第一个可以转换的错误
+func (e MultiError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,14 +1,21 @@
 package rabbitmq
 
 import (
-	//"errors"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/streadway/amqp"
 	"log"
+	"os"
+	"sync"
+	"time"
 )
 
-// 定义全局变量,指针类型
-var mqConn *amqp.Connection
+// ShutdownTimeout RecvCtx 退出时等待处理中消息完成的最长时间
+var ShutdownTimeout = 30 * time.Second
+
+// ErrShutdownTimeout 等待处理中的消息超时
+var ErrShutdownTimeout = errors.New("rabbitmq: shutdown timeout waiting for in-flight messages")
 
 //var mqChan *amqp.Channel
 
@@ -31,15 +38,29 @@ type Receiver interface {
 	Recv(int)
 }
 
+// DeliveryReceiver 可选接口, Receiver 实现后消费时收到完整的消息(含属性与headers), 替代 Consumer 调用
+type DeliveryReceiver interface {
+	ConsumeDelivery(context.Context, amqp.Delivery) error
+}
+
+// consumeMsg 调用接收者处理消息
+func consumeMsg(ctx context.Context, receiver Receiver, msg amqp.Delivery) error {
+	if r, ok := receiver.(DeliveryReceiver); ok {
+		return r.ConsumeDelivery(ctx, msg)
+	}
+	return receiver.Consumer(msg.Body)
+}
+
 // RabbitMQ 定义RabbitMQ对象
 type RabbitMQ struct {
-	connection        *amqp.Connection
+	conn              *Connection
 	Channel           *amqp.Channel
 	dns               string
 	QueueName         string // 队列名称
 	RoutingKey        string // key名称
 	ExchangeName      string // 交换机名称
 	ExchangeType      string // 交换机类型
+	queueExchange     QueueExchange
 	producerList      []Producer
 	retryProducerList []RetryProducer
 	receiverList      []Receiver
@@ -47,30 +68,53 @@ type RabbitMQ struct {
 
 // QueueExchange 定义队列交换机对象
 type QueueExchange struct {
-	QuName string // 队列名称
-	RtKey  string // key值
-	ExName string // 交换机名称
-	ExType string // 交换机类型
-	Dns    string //链接地址
+	QuName string       // 队列名称
+	RtKey  string       // key值
+	ExName string       // 交换机名称
+	ExType string       // 交换机类型
+	Dns    string       //链接地址, amqp地址、内存broker地址或 RegisterConnConfig 注册的连接名称
+	Retry  *RetryPolicy // 失败重试策略, 为空时使用 DefaultRetryPolicy
+
+	Prefetch    int    // 每个消费协程的预取数量, 默认1
+	ConsumerTag string // 消费者标签前缀, 默认为 主机名-进程号-队列名
+
+	BatchSize int           // 批量消费每批最多的消息数量, 默认100, 仅 RecvBatch 使用
+	BatchWait time.Duration // 批量消费未凑满一批时的最长等待时间, 默认1秒, 仅 RecvBatch 使用
+
+	Middlewares []Middleware // 当前队列的消费中间件, 在全局中间件之后执行
+
+	MaxPriority uint8      // 队列支持的最大优先级(x-max-priority), 0 表示不开启
+	QueueArgs   amqp.Table // 声明队列时的其他参数, 如 x-queue-type、x-max-length
+	SkipDeclare bool       // 拓扑已由 Topology.Apply 统一声明时跳过声明
+	PollDepth   bool       // 消费期间每隔 QueueDepthInterval 上报队列深度, 会额外使用生产者的共享连接
+
+	Partitions int          // 顺序消费的分区数量, 默认 DefaultPartitions, 生产者与消费者必须一致, 仅 SendOrdered/RecvOrdered 使用
+	ShardKey   ShardKeyFunc // 未指定分区key时从消息中提取, 默认取 ShardKeyHeader 的值
 }
 
 // MqConnect 链接rabbitMQ
+// 链接断开后会在后台自动重连, 直到调用 CloseMqConnect
 func (mq *RabbitMQ) MqConnect() (err error) {
 
-	mqConn, err = amqp.Dial(mq.dns)
-	mq.connection = mqConn // 赋值给RabbitMQ对象
+	mq.conn = NewConnection(mq.dns)
+	err = mq.conn.Connect()
 
 	if err != nil {
-		fmt.Printf("关闭mq链接失败  :%s \n", err)
+		fmt.Printf("链接mq失败  :%s \n", err)
 	}
 
 	return
 }
 
+// Connection 获取自愈连接对象, 可用于监听连接状态
+func (mq *RabbitMQ) Connection() *Connection {
+	return mq.conn
+}
+
 // CloseMqConnect 关闭mq链接
 func (mq *RabbitMQ) CloseMqConnect() (err error) {
 
-	err = mq.connection.Close()
+	err = mq.conn.Close()
 	if err != nil {
 		fmt.Printf("关闭mq链接失败  :%s \n", err)
 	}
@@ -79,8 +123,7 @@ func (mq *RabbitMQ) CloseMqConnect() (err error) {
 
 // MqOpenChannel 链接rabbitMQ
 func (mq *RabbitMQ) MqOpenChannel() (err error) {
-	mqConn := mq.connection
-	mq.Channel, err = mqConn.Channel()
+	mq.Channel, err = mq.conn.Channel()
 	//defer mqChan.Close()
 	if err != nil {
 		fmt.Printf("MQ打开管道失败:%s \n", err)
@@ -97,309 +140,342 @@ func (mq *RabbitMQ) CloseMqChannel() (err error) {
 	return err
 }
 
+// options 当前对象对应的队列交换机配置
+func (mq *RabbitMQ) options() QueueExchange {
+	q := mq.queueExchange
+	q.QuName = mq.QueueName
+	q.RtKey = mq.RoutingKey
+	q.ExName = mq.ExchangeName
+	q.ExType = mq.ExchangeType
+	q.Dns = mq.dns
+	return q
+}
+
 // NewMq 创建一个新的操作对象
 func NewMq(q QueueExchange) RabbitMQ {
 	return RabbitMQ{
-		QueueName:    q.QuName,
-		RoutingKey:   q.RtKey,
-		ExchangeName: q.ExName,
-		ExchangeType: q.ExType,
-		dns:          q.Dns,
+		QueueName:     q.QuName,
+		RoutingKey:    q.RtKey,
+		ExchangeName:  q.ExName,
+		ExchangeType:  q.ExType,
+		dns:           q.Dns,
+		queueExchange: q,
 	}
 }
 
-// sendMsg
-func (mq *RabbitMQ) sendMsg(body string) {
-	err := mq.MqOpenChannel()
-	ch := mq.Channel
-	if err != nil {
-		log.Printf("Channel err  :%s \n", err)
-	}
+// ListenReceiver 监听接收者接收任务 消费者
+// 连接或管道断开后会等待连接恢复, 重新声明交换机/队列/绑定并继续消费
+func (mq *RabbitMQ) ListenReceiver(receiver Receiver, routineNum int) {
+	mq.ListenReceiverCtx(context.Background(), receiver, routineNum)
+}
 
-	defer func(Channel *amqp.Channel) {
-		err := Channel.Close()
-		if err != nil {
+// ListenReceiverCtx 监听接收者接收任务, ctx 结束时取消消费并在当前消息处理完成后返回
+func (mq *RabbitMQ) ListenReceiverCtx(ctx context.Context, receiver Receiver, routineNum int) {
+	mq.listen(ctx, routineNum, func() (bool, error) {
+		return mq.consume(ctx, receiver, routineNum)
+	})
+}
 
+// listen 循环消费直到ctx结束或连接关闭, 中断后按退避策略恢复
+func (mq *RabbitMQ) listen(ctx context.Context, routineNum int, consume func() (started bool, err error)) {
+	attempt := 0
+	for {
+		if err := mq.conn.WaitReady(ctx); err != nil {
+			return
+		}
+		started, err := consume()
+		if mq.conn.IsClosed() || ctx.Err() != nil {
+			return
 		}
-	}(mq.Channel)
-	if mq.ExchangeName != "" {
-		if mq.ExchangeType == "" {
-			mq.ExchangeType = "direct"
+		if started {
+			attempt = 0
 		}
-		err = ch.ExchangeDeclare(mq.ExchangeName, mq.ExchangeType, true, false, false, false, nil)
-		if err != nil {
-			log.Printf("ExchangeDeclare err  :%s \n", err)
+		attempt++
+		log.Printf("[%s#%d] 消费者中断, 准备恢复(第%d次) :%v \n", mq.QueueName, routineNum, attempt, err)
+		t := time.NewTimer(backoff(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-mq.conn.done:
+			t.Stop()
+			return
 		}
 	}
+}
 
-	// 用于检查队列是否存在,已经存在不需要重复声明
-	_, err = ch.QueueDeclare(mq.QueueName, true, false, false, false, nil)
+// consume 打开当前协程独占的管道并消费, 直到管道关闭时返回关闭原因, started 表示是否已成功开始消费
+// ctx 结束时取消消费, 已预取未处理的消息会在管道关闭后由broker重新投递
+func (mq *RabbitMQ) consume(ctx context.Context, receiver Receiver, routineNum int) (started bool, err error) {
+	// 预取数量, 默认确保rabbitMQ一个一个发送消息
+	prefetch := mq.queueExchange.Prefetch
+	if prefetch <= 0 {
+		prefetch = 1
+	}
+	sub, err := mq.subscribe(routineNum, prefetch)
 	if err != nil {
-		log.Printf("QueueDeclare err :%s \n", err)
+		return false, err
 	}
-	// 绑定任务
-	if mq.RoutingKey != "" && mq.ExchangeName != "" {
-		err = ch.QueueBind(mq.QueueName, mq.RoutingKey, mq.ExchangeName, false, nil)
-		if err != nil {
-			log.Printf("QueueBind err :%s \n", err)
+	defer func() {
+		_ = sub.ch.Close()
+	}()
+	ch, tag, msgList := sub.ch, sub.tag, sub.deliveries
+	handler := mq.handler(receiver)
+	for {
+		var msg amqp.Delivery
+		var ok bool
+		select {
+		case <-ctx.Done():
+			// 停止接收新消息, 返回后关闭管道
+			if err := ch.Cancel(tag, false); err != nil {
+				log.Printf("[%s#%d] Cancel err :%s \n", mq.QueueName, routineNum, err)
+			}
+			return true, ctx.Err()
+		case msg, ok = <-msgList:
+		}
+		if !ok {
+			break
 		}
-	}
 
-	if mq.ExchangeName != "" && mq.RoutingKey != "" {
-		err = mq.Channel.Publish(
-			mq.ExchangeName, // exchange
-			mq.RoutingKey,   // routing key
-			false,           // mandatory
-			false,           // immediate
-			amqp.Publishing{
-				ContentType: "text/plain",
-				Body:        []byte(body),
-			})
-	} else {
-		err = mq.Channel.Publish(
-			"",           // exchange
-			mq.QueueName, // routing key
-			false,        // mandatory
-			false,        // immediate
-			amqp.Publishing{
-				ContentType: "text/plain",
-				Body:        []byte(body),
-			})
+		mq.handle(msg, handler, receiver, routineNum)
 	}
+	return true, sub.closeReason()
+}
 
+// subscription 消费协程独占的管道与消费者
+type subscription struct {
+	ch         channel
+	tag        string
+	deliveries <-chan amqp.Delivery
+	closes     chan *amqp.Error
 }
 
-func (mq *RabbitMQ) sendRetryMsg(body string, retryNums int32, args ...string) {
-	err := mq.MqOpenChannel()
-	ch := mq.Channel
+// subscribe 打开独占的管道, 声明拓扑并开始消费, 失败时关闭管道
+func (mq *RabbitMQ) subscribe(routineNum, prefetch int) (*subscription, error) {
+	// 每个消费协程使用独立的管道, 不共享 mq.Channel
+	ch, err := mq.conn.channel()
 	if err != nil {
-		log.Printf("Channel err  :%s \n", err)
+		log.Printf("[%s#%d] Channel err  :%s \n", mq.QueueName, routineNum, err)
+		return nil, err
 	}
-	defer func(Channel *amqp.Channel) {
-		_ = Channel.Close()
-	}(mq.Channel)
-
-	if mq.ExchangeName != "" {
-		if mq.ExchangeType == "" {
-			mq.ExchangeType = "direct"
-		}
-		err = ch.ExchangeDeclare(mq.ExchangeName, mq.ExchangeType, true, false, false, false, nil)
-		if err != nil {
-			log.Printf("ExchangeDeclare err  :%s \n", err)
-		}
+	sub := &subscription{ch: ch, tag: mq.tag(routineNum), closes: ch.NotifyClose(make(chan *amqp.Error, 1))}
+	if err = queueTopology(mq.options()).declare(ch); err != nil {
+		_ = ch.Close()
+		return nil, err
 	}
-
-	//原始路由key
-	oldRoutingKey := args[0]
-	//原始交换机名
-	oldExchangeName := args[1]
-
-	table := make(map[string]interface{}, 3)
-	table["x-dead-letter-routing-key"] = oldRoutingKey
-	if oldExchangeName != "" {
-		table["x-dead-letter-exchange"] = oldExchangeName
-	} else {
-		mq.ExchangeName = ""
-		table["x-dead-letter-exchange"] = ""
+	if err = ch.Qos(prefetch, 0, false); err != nil {
+		log.Printf("[%s#%d] Qos err :%s \n", mq.QueueName, routineNum, err)
+		_ = ch.Close()
+		return nil, err
 	}
-
-	table["x-message-ttl"] = int64(20000)
-
-	//fmt.Printf("%+v",table)
-	//fmt.Printf("%+v",mq)
-	// 用于检查队列是否存在,已经存在不需要重复声明
-	_, err = ch.QueueDeclare(mq.QueueName, true, false, false, false, table)
+	sub.deliveries, err = ch.Consume(mq.QueueName, sub.tag, false, false, false, false, nil)
 	if err != nil {
-		log.Printf("QueueDeclare err :%s \n", err)
+		log.Printf("[%s#%d] Consume err :%s \n", mq.QueueName, routineNum, err)
+		_ = ch.Close()
+		return nil, err
 	}
-	// 绑定任务
-	if mq.RoutingKey != "" && mq.ExchangeName != "" {
-		err = ch.QueueBind(mq.QueueName, mq.RoutingKey, mq.ExchangeName, false, nil)
-		if err != nil {
-			log.Printf("QueueBind err :%s \n", err)
+	return sub, nil
+}
+
+// closeReason 管道或连接关闭后取出关闭原因
+func (s *subscription) closeReason() error {
+	select {
+	case reason, ok := <-s.closes:
+		if ok && reason != nil {
+			return reason
 		}
+	case <-time.After(time.Second):
 	}
+	return amqp.ErrClosed
+}
 
-	header := make(map[string]interface{}, 1)
-
-	header["retry_nums"] = retryNums + int32(1)
-
-	var ttlExchange string
-	var ttlRoutkey string
-
-	if mq.ExchangeName != "" {
-		ttlExchange = mq.ExchangeName
-	} else {
-		ttlExchange = ""
+// handler 组装中间件与接收者, 最外层始终捕获panic
+func (mq *RabbitMQ) handler(receiver Receiver) HandlerFunc {
+	final := func(ctx context.Context, d *Delivery) error {
+		return consumeMsg(ctx, receiver, d.Delivery)
 	}
+	mws := make([]Middleware, 0, len(middlewares())+len(mq.queueExchange.Middlewares)+1)
+	mws = append(mws, Recovery())
+	mws = append(mws, middlewares()...)
+	mws = append(mws, mq.queueExchange.Middlewares...)
+	return Chain(mws...)(final)
+}
 
-	if mq.RoutingKey != "" && mq.ExchangeName != "" {
-		ttlRoutkey = mq.RoutingKey
-	} else {
-		ttlRoutkey = mq.QueueName
+// handle 处理单条消息并确认
+// 处理失败时按重试策略投递到延迟队列, 重试次数用尽后投递到停放队列并调用 FailAction
+// 重试或停放消息发送失败时拒绝并重新入队, 避免消息丢失
+func (mq *RabbitMQ) handle(msg amqp.Delivery, handler HandlerFunc, receiver Receiver, routineNum int) {
+	if remaining := delayRemaining(msg); remaining > 0 {
+		mq.redelay(msg, remaining, routineNum)
+		return
 	}
-
-	//fmt.Printf("ttl_exchange:%s,ttl_routkey:%s \n",ttl_exchange,ttl_routkey)
-	err = mq.Channel.Publish(
-		ttlExchange, // exchange
-		ttlRoutkey,  // routing key
-		false,       // mandatory
-		false,       // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(body),
-			Headers:     header,
-		})
-	if err != nil {
-		fmt.Printf("MQ任务发送失败:%s \n", err)
-
+	retryNums := retryCount(msg)
+	// 处理数据, 退出时不取消正在处理的消息
+	span, ctx := startConsumeSpan(context.Background(), mq.QueueName, retryNums, msg)
+	metrics().MessageConsumed(mq.QueueName, lag(msg))
+	start := time.Now()
+	err := handler(ctx, &Delivery{Delivery: msg, Queue: mq.QueueName, RetryNums: retryNums, Worker: routineNum})
+	metrics().ObserveHandler(mq.QueueName, time.Since(start), err)
+	defer func() {
+		finishSpan(span, err)
+	}()
+	if err == nil {
+		// 确认消息,必须为false
+		if ackErr := msg.Ack(false); ackErr != nil {
+			fmt.Printf("[%s#%d] 消息消费ack失败 err :%s \n", mq.QueueName, routineNum, ackErr)
+		} else {
+			metrics().MessageAcked(mq.QueueName, 1)
+		}
+		return
 	}
 
+	mq.fail(ctx, msg, retryNums, err, receiver.FailAction, routineNum)
 }
 
-// ListenReceiver 监听接收者接收任务 消费者
-func (mq *RabbitMQ) ListenReceiver(receiver Receiver, routineNum int) {
-	err := mq.MqOpenChannel()
-	ch := mq.Channel
-	if err != nil {
-		log.Printf("Channel err  :%s \n", err)
-	}
-	defer func(Channel *amqp.Channel) {
-		_ = Channel.Close()
-	}(mq.Channel)
-	if mq.ExchangeName != "" {
-		if mq.ExchangeType == "" {
-			mq.ExchangeType = "direct"
-		}
-		err = ch.ExchangeDeclare(mq.ExchangeName, mq.ExchangeType, true, false, false, false, nil)
-		if err != nil {
-			log.Printf("ExchangeDeclare err  :%s \n", err)
+// fail 消息处理失败, 进入延时重试机制, 重试次数用尽后停放并调用 failAction
+func (mq *RabbitMQ) fail(ctx context.Context, msg amqp.Delivery, retryNums int32, err error, failAction func(error, []byte) error, routineNum int) {
+	var sendErr error
+	policy := mq.options().retryPolicy()
+	switch kind, delay := classify(err, retryNums, policy); kind {
+	case failureRequeue:
+		log.Printf("[%s#%d] 消息处理失败, 重新入队 :%s \n", mq.QueueName, routineNum, err)
+		mq.requeue(msg, routineNum)
+		return
+	case failureRetry:
+		log.Printf("[%s#%d] 消息处理失败, 第%d次重试 :%s \n", mq.QueueName, routineNum, retryNums+1, err)
+		if sendErr = retryMsg(ctx, msg, retryNums, err, mq.options(), delay, true); sendErr != nil {
+			log.Printf("[%s#%d] MQ重试任务发送失败:%s \n", mq.QueueName, routineNum, sendErr)
+		} else {
+			metrics().MessageRetried(mq.QueueName)
 		}
-	}
-
-	// 用于检查队列是否存在,已经存在不需要重复声明
-	_, err = ch.QueueDeclare(mq.QueueName, true, false, false, false, nil)
-	if err != nil {
-		log.Printf("QueueDeclare err :%s \n", err)
-	}
-	// 绑定任务
-	if mq.RoutingKey != "" && mq.ExchangeName != "" {
-		err = ch.QueueBind(mq.QueueName, mq.RoutingKey, mq.ExchangeName, false, nil)
-		if err != nil {
-			log.Printf("QueueBind err :%s \n", err)
+	case failureDefer:
+		log.Printf("[%s#%d] 消息延迟%s后重新投递 :%s \n", mq.QueueName, routineNum, delay, err)
+		if sendErr = retryMsg(ctx, msg, retryNums, err, mq.options(), delay, false); sendErr != nil {
+			log.Printf("[%s#%d] MQ重试任务发送失败:%s \n", mq.QueueName, routineNum, sendErr)
 		}
-	}
-	// 获取消费通道,确保rabbitMQ一个一个发送消息
-	err = ch.Qos(1, 0, false)
-	msgList, err := ch.Consume(mq.QueueName, "sgen-1", false, false, false, false, nil)
-	if err != nil {
-		log.Printf("Consume err :%s \n", err)
-	}
-	for msg := range msgList {
-		retryNums, ok := msg.Headers["retry_nums"].(int32)
-		if !ok {
-			retryNums = int32(0)
+	default:
+		if errors.Is(err, ErrPermanent) {
+			log.Printf("[%s#%d] 消息处理永久失败, 转入停放队列 :%s \n", mq.QueueName, routineNum, err)
+		} else {
+			log.Printf("[%s#%d] 消息重试%d次后仍失败, 转入停放队列 :%s \n", mq.QueueName, routineNum, retryNums, err)
 		}
-		// 处理数据
-		err := receiver.Consumer(msg.Body)
-		if err != nil {
-			//消息处理失败 进入延时尝试机制
-			if retryNums < 3 {
-				retryMsg(msg.Body, retryNums, QueueExchange{
-					mq.QueueName,
-					mq.RoutingKey,
-					mq.ExchangeName,
-					mq.ExchangeType,
-					mq.dns,
-				})
-				fmt.Println(err)
-			} else {
-				// TODO 消息失败 入库db
-				_ = receiver.FailAction(err, msg.Body)
-			}
-			err = msg.Ack(true)
-			if err != nil {
-				fmt.Printf("确认消息未完成异常:%s \n", err)
-			}
+		if sendErr = parkMsg(ctx, msg, retryNums, err, mq.options()); sendErr != nil {
+			log.Printf("[%s#%d] MQ停放任务发送失败:%s \n", mq.QueueName, routineNum, sendErr)
 		} else {
-			// 确认消息,必须为false
-			err = msg.Ack(true)
-
-			if err != nil {
-				fmt.Printf("消息消费ack失败 err :%s \n", err)
-			}
+			metrics().MessageParked(mq.QueueName)
 		}
-
+		_ = failAction(err, msg.Body)
+	}
+	if sendErr != nil {
+		mq.requeue(msg, routineNum)
+		return
+	}
+	if ackErr := msg.Ack(false); ackErr != nil {
+		fmt.Printf("[%s#%d] 确认消息未完成异常:%s \n", mq.QueueName, routineNum, ackErr)
+	} else {
+		metrics().MessageAcked(mq.QueueName, 1)
 	}
 }
 
-// retryMsg 消息处理失败之后 延时尝试
-func retryMsg(msg []byte, retryNums int32, queueExchange QueueExchange) {
-	//原始队列名称 交换机名称
-	oldQName := queueExchange.QuName
-	oldExchangeName := queueExchange.ExName
-	oldRoutingKey := queueExchange.RtKey
-	if oldRoutingKey == "" || oldExchangeName == "" {
-		oldRoutingKey = oldQName
+// requeue 拒绝消息并重新入队
+func (mq *RabbitMQ) requeue(msg amqp.Delivery, routineNum int) {
+	if nackErr := msg.Nack(false, true); nackErr != nil {
+		fmt.Printf("[%s#%d] 消息重新入队失败:%s \n", mq.QueueName, routineNum, nackErr)
+		return
 	}
+	metrics().MessageRequeued(mq.QueueName)
+}
 
-	if queueExchange.QuName != "" {
-		queueExchange.QuName = queueExchange.QuName + "_retry_3"
+// lag 消息生成到被消费的时间, 消息未带时间戳时为0
+func lag(msg amqp.Delivery) time.Duration {
+	if msg.Timestamp.IsZero() {
+		return 0
 	}
+	return time.Since(msg.Timestamp)
+}
 
-	if queueExchange.RtKey != "" {
-		queueExchange.RtKey = queueExchange.RtKey + "_retry_3"
-	} else {
-		queueExchange.RtKey = queueExchange.QuName + "_retry_3"
+// tag 消费协程的唯一消费者标签
+func (mq *RabbitMQ) tag(routineNum int) string {
+	prefix := mq.queueExchange.ConsumerTag
+	if prefix == "" {
+		host, _ := os.Hostname()
+		prefix = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), mq.QueueName)
 	}
-
-	//fmt.Printf("%+v",queueExchange)
-
-	mq := NewMq(queueExchange)
-	_ = mq.MqConnect()
-
-	defer func() {
-		_ = mq.CloseMqConnect()
-	}()
-	//fmt.Printf("%+v",queueExchange)
-	mq.sendRetryMsg(string(msg), retryNums, oldRoutingKey, oldExchangeName)
-
+	return fmt.Sprintf("%s-%d", prefix, routineNum)
 }
 
-// Send 生产者
-func Send(queueExchange QueueExchange, msg string) {
-	mq := NewMq(queueExchange)
-	_ = mq.MqConnect()
-
-	defer func() {
-		_ = mq.CloseMqConnect()
-	}()
-	mq.sendMsg(msg)
+// Send 生产者, 等待broker确认, 超时时间为 PublishTimeout
+// 消息默认持久化, 可通过 opts 设置优先级、过期时间、headers等属性
+func Send(queueExchange QueueExchange, msg string, opts ...PublishOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	return SendCtx(ctx, queueExchange, msg, opts...)
+}
 
+// SendCtx 生产者, broker确认(ack)后才返回
+// 被拒绝返回 ErrNack, 无法路由返回 ErrUnroutable, ctx结束返回 ErrPublishTimeout, 均包装为 *PublishError
+// 复用按连接地址共享的 Publisher, 不会每次发送都重新建立连接
+func SendCtx(ctx context.Context, queueExchange QueueExchange, msg string, opts ...PublishOption) error {
+	return getPublisher(queueExchange.Dns).Publish(ctx, queueExchange, msg, opts...)
 }
 
 // Recv 消费者
-// runNums  开启并发执行任务数量
+// runNums  开启并发执行任务数量, 每个协程使用独立的管道与消费者标签, 预取数量由 QueueExchange.Prefetch 控制
 func Recv(queueExchange QueueExchange, receiver Receiver, runNums int) {
+	_ = RecvCtx(context.Background(), queueExchange, receiver, runNums)
+}
+
+// RecvCtx 消费者, ctx 结束时优雅退出
+// 先取消所有消费者, 等待正在执行的 Receiver.Consumer 完成(最长 ShutdownTimeout), 再依次关闭管道与连接
+// 等待超时返回 ErrShutdownTimeout, 未完成的消息因未ack会被broker重新投递
+func RecvCtx(ctx context.Context, queueExchange QueueExchange, receiver Receiver, runNums int) error {
+	return serve(ctx, queueExchange, runNums, func(mq *RabbitMQ, routineNum int) {
+		mq.ListenReceiverCtx(ctx, receiver, routineNum)
+	})
+}
+
+// serve 启动 runNums 个消费协程, ctx 结束后等待协程退出并关闭连接
+func serve(ctx context.Context, queueExchange QueueExchange, runNums int, listen func(mq *RabbitMQ, routineNum int)) error {
 	mq := NewMq(queueExchange)
 	_ = mq.MqConnect()
 
-	defer func() {
-		_ = mq.CloseMqConnect()
-	}()
-
-	forever := make(chan bool)
+	if runNums <= 0 {
+		runNums = 1
+	}
+	var wg sync.WaitGroup
+	if queueExchange.PollDepth && QueueDepthInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			PollQueueDepth(ctx, queueExchange.Dns, QueueDepthInterval, mq.QueueName)
+		}()
+	}
 	for i := 1; i <= runNums; i++ {
+		wg.Add(1)
 		go func(routineNum int) {
-			defer func(Channel *amqp.Channel) {
-				if Channel != nil {
-					_ = Channel.Close()
-				}
-			}(mq.Channel)
-			// 验证链接是否正常
-			_ = mq.MqOpenChannel()
-			mq.ListenReceiver(receiver, routineNum)
+			defer wg.Done()
+			// 连接断开时 ListenReceiverCtx 会等待重连后继续消费
+			listen(&mq, routineNum)
 		}(i)
 	}
-	<-forever
+	<-ctx.Done()
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	var err error
+	t := time.NewTimer(ShutdownTimeout)
+	defer t.Stop()
+	select {
+	case <-finished:
+	case <-t.C:
+		err = ErrShutdownTimeout
+		log.Printf("[%s] 等待消费者退出超时 \n", mq.QueueName)
+	}
+	_ = mq.CloseMqConnect()
+	return err
 }
@@ -0,0 +1,1083 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// memoryScheme 内存broker的连接地址前缀
+const memoryScheme = "memory://"
+
+var (
+	memoryMu      sync.Mutex
+	memoryBrokers = make(map[string]*MemoryBroker)
+)
+
+// MemoryBroker 进程内的broker, 用于单元测试, 不需要网络
+// 将 QueueExchange.Dns 设置为 DNS() 返回的 memory:// 地址后, Send/Recv/Publisher/Parking/Topology/RPC 均在内存中完成
+// 支持 direct/fanout/topic/headers 交换机、ack/nack、prefetch、publisher confirm、mandatory、
+// 队列与消息TTL、死信交换机(含 x-death)、x-max-length/x-overflow、x-max-priority
+//
+//	b := rabbitmq.NewMemoryBroker(t.Name())
+//	defer b.Close()
+//	qe := rabbitmq.QueueExchange{QuName: "order", Dns: b.DNS()}
+type MemoryBroker struct {
+	name string
+
+	mu        sync.Mutex
+	closed    bool
+	seq       uint64 // 生成队列名与消费者标签
+	exchanges map[string]*memoryExchange
+	queues    map[string]*memoryQueue
+	channels  map[*memoryChannel]bool
+}
+
+type memoryExchange struct {
+	name     string
+	kind     string
+	bindings []memoryBinding
+}
+
+type memoryBinding struct {
+	queue string
+	key   string
+	args  amqp.Table
+}
+
+type memoryQueue struct {
+	name      string
+	args      amqp.Table
+	owner     *memoryChannel // 独占队列所属的管道, 管道关闭时删除队列
+	ready     []*memoryMessage
+	unacked   int
+	consumers []*memoryConsumer
+	next      int // 轮询分发的下一个消费者
+}
+
+type memoryMessage struct {
+	msg         amqp.Publishing
+	exchange    string
+	key         string
+	redelivered bool
+	expired     bool // 未确认期间已过期, 放回队列时直接进入死信
+}
+
+// NewMemoryBroker 创建并注册内存broker, 同名broker已存在时会先关闭旧的
+func NewMemoryBroker(name string) *MemoryBroker {
+	if name == "" {
+		name = NewMessageID()
+	}
+	b := &MemoryBroker{
+		name:      name,
+		exchanges: make(map[string]*memoryExchange),
+		queues:    make(map[string]*memoryQueue),
+		channels:  make(map[*memoryChannel]bool),
+	}
+	memoryMu.Lock()
+	old := memoryBrokers[b.DNS()]
+	memoryBrokers[b.DNS()] = b
+	memoryMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	// 共享生产者可能缓存了旧broker上已声明的拓扑
+	closePublisher(b.DNS())
+	return b
+}
+
+// isMemoryDNS 是否为内存broker地址
+func isMemoryDNS(dns string) bool {
+	return strings.HasPrefix(dns, memoryScheme)
+}
+
+// lookupMemoryBroker 查找地址对应的内存broker, 不存在时返回nil
+func lookupMemoryBroker(dns string) *MemoryBroker {
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	return memoryBrokers[dns]
+}
+
+// DNS 连接地址, 用于 QueueExchange.Dns
+func (b *MemoryBroker) DNS() string {
+	return memoryScheme + b.name
+}
+
+// Close 关闭broker, 所有管道被关闭, 消费者会像断线一样退出
+func (b *MemoryBroker) Close() {
+	memoryMu.Lock()
+	if memoryBrokers[b.DNS()] == b {
+		delete(memoryBrokers, b.DNS())
+	}
+	memoryMu.Unlock()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	channels := make([]*memoryChannel, 0, len(b.channels))
+	for ch := range b.channels {
+		channels = append(channels, ch)
+	}
+	b.mu.Unlock()
+
+	reason := &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker closed", Server: true}
+	for _, ch := range channels {
+		_ = ch.shutdown(reason)
+	}
+	closePublisher(b.DNS())
+}
+
+// Queues 已声明的队列名称
+func (b *MemoryBroker) Queues() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.queues))
+	for name := range b.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// QueueDepth 队列中待投递与已投递未确认的消息数量, 队列不存在时均为0
+func (b *MemoryBroker) QueueDepth(queue string) (ready, unacked int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	if !ok {
+		return 0, 0
+	}
+	return len(q.ready), q.unacked
+}
+
+// Messages 队列中待投递消息的快照, 不会移除消息, 返回的消息不能ack
+func (b *MemoryBroker) Messages(queue string) []amqp.Delivery {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]amqp.Delivery, 0)
+	q, ok := b.queues[queue]
+	if !ok {
+		return list
+	}
+	for i, m := range q.ready {
+		d := m.delivery()
+		d.MessageCount = uint32(len(q.ready) - i - 1)
+		list = append(list, d)
+	}
+	return list
+}
+
+// channel 打开一个管道
+func (b *MemoryBroker) channel() (*memoryChannel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrNotConnected
+	}
+	ch := &memoryChannel{
+		b:         b,
+		unacked:   make(map[uint64]memoryUnacked),
+		consumers: make(map[string]*memoryConsumer),
+	}
+	b.channels[ch] = true
+	return ch, nil
+}
+
+// route 查找消息路由到的队列, 交换机不存在时返回 NOT_FOUND
+func (b *MemoryBroker) route(exchange, key string, headers amqp.Table) ([]*memoryQueue, *amqp.Error) {
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*memoryQueue{q}, nil
+		}
+		return nil, nil
+	}
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return nil, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange), Server: true}
+	}
+	seen := make(map[string]bool)
+	list := make([]*memoryQueue, 0)
+	for _, bind := range e.bindings {
+		if seen[bind.queue] || !e.matches(bind, key, headers) {
+			continue
+		}
+		if q, ok := b.queues[bind.queue]; ok {
+			seen[bind.queue] = true
+			list = append(list, q)
+		}
+	}
+	return list, nil
+}
+
+// enqueue 消息入队并分发, 队列已满且拒绝新消息时返回false
+func (b *MemoryBroker) enqueue(q *memoryQueue, m *memoryMessage) bool {
+	if max := toInt64(q.args["x-max-length"]); max > 0 && int64(len(q.ready)) >= max {
+		switch q.args["x-overflow"] {
+		case "reject-publish", "reject-publish-dlx":
+			return false
+		}
+		head := q.ready[0]
+		q.ready = q.ready[1:]
+		b.deadLetter(q, head, "maxlen")
+	}
+	if max := toInt64(q.args["x-max-priority"]); max > 0 {
+		p := m.priority(max)
+		i := len(q.ready)
+		for i > 0 && q.ready[i-1].priority(max) < p {
+			i--
+		}
+		q.ready = append(q.ready, nil)
+		copy(q.ready[i+1:], q.ready[i:])
+		q.ready[i] = m
+	} else {
+		q.ready = append(q.ready, m)
+	}
+	if ttl, ok := messageTTL(q, m.msg); ok {
+		time.AfterFunc(ttl, func() {
+			b.expire(q, m)
+		})
+	}
+	b.dispatch(q)
+	return true
+}
+
+// expire 消息过期, 仍在队列中时进入死信
+func (b *MemoryBroker) expire(q *memoryQueue, m *memoryMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.queues[q.name] != q {
+		return
+	}
+	for i, r := range q.ready {
+		if r == m {
+			q.ready = append(q.ready[:i:i], q.ready[i+1:]...)
+			b.deadLetter(q, m, "expired")
+			return
+		}
+	}
+	m.expired = true
+}
+
+// requeue 消息放回队列头部
+func (b *MemoryBroker) requeue(q *memoryQueue, m *memoryMessage) {
+	if b.queues[q.name] != q {
+		return
+	}
+	if m.expired {
+		b.deadLetter(q, m, "expired")
+		return
+	}
+	m.redelivered = true
+	q.ready = append([]*memoryMessage{m}, q.ready...)
+}
+
+// deadLetter 按队列的 x-dead-letter-exchange 投递死信, 没有配置时丢弃
+func (b *MemoryBroker) deadLetter(q *memoryQueue, m *memoryMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.key
+	if k, ok := q.args["x-dead-letter-routing-key"].(string); ok && k != "" {
+		key = k
+	}
+	msg := m.msg
+	msg.Headers = copyTable(msg.Headers)
+	msg.Headers["x-death"] = xDeath(msg.Headers["x-death"], q.name, reason, m)
+	// 与RabbitMQ一致, 死信消息去掉过期时间, 避免在目标队列中再次过期
+	msg.Expiration = ""
+	queues, err := b.route(dlx, key, msg.Headers)
+	if err != nil {
+		return
+	}
+	for _, target := range queues {
+		b.enqueue(target, &memoryMessage{msg: msg, exchange: dlx, key: key})
+	}
+}
+
+// dispatch 将待投递消息轮询分发给有余量的消费者
+// 队列开启 x-single-active-consumer 时只分发给最早的消费者, 其取消后由下一个消费者接替
+func (b *MemoryBroker) dispatch(q *memoryQueue) {
+	single, _ := q.args["x-single-active-consumer"].(bool)
+	for len(q.ready) > 0 && len(q.consumers) > 0 {
+		n := len(q.consumers)
+		if single {
+			q.next, n = 0, 1
+		}
+		var c *memoryConsumer
+		for i := 0; i < n; i++ {
+			candidate := q.consumers[(q.next+i)%len(q.consumers)]
+			if candidate.autoAck || candidate.prefetch <= 0 || candidate.inflight < candidate.prefetch {
+				c = candidate
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if c == nil {
+			return
+		}
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		d := c.ch.deliver(q, m, c, c.autoAck)
+		d.ConsumerTag = c.tag
+		c.push(d)
+	}
+}
+
+// removeConsumer 移除消费者, 已投递未确认的消息仍属于管道
+func (b *MemoryBroker) removeConsumer(c *memoryConsumer) {
+	q := c.queue
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.next >= len(q.consumers) {
+		q.next = 0
+	}
+	delete(c.ch.consumers, c.tag)
+	close(c.stop)
+}
+
+// deleteQueue 删除队列及其绑定与消费者
+func (b *MemoryBroker) deleteQueue(q *memoryQueue) {
+	delete(b.queues, q.name)
+	for _, e := range b.exchanges {
+		bindings := e.bindings[:0]
+		for _, bind := range e.bindings {
+			if bind.queue != q.name {
+				bindings = append(bindings, bind)
+			}
+		}
+		e.bindings = bindings
+	}
+	for _, c := range append([]*memoryConsumer{}, q.consumers...) {
+		b.removeConsumer(c)
+	}
+}
+
+// matches 绑定是否匹配路由key或headers
+func (e *memoryExchange) matches(bind memoryBinding, key string, headers amqp.Table) bool {
+	switch e.kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatch(strings.Split(bind.key, "."), strings.Split(key, "."))
+	case amqp.ExchangeHeaders:
+		return headersMatch(bind.args, headers)
+	}
+	return bind.key == key
+}
+
+// topicMatch topic交换机匹配, * 匹配一个单词, # 匹配零个或多个单词
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+}
+
+// headersMatch headers交换机匹配, x-match 为 any 时任意一个匹配即可, 默认全部匹配
+func headersMatch(args, headers amqp.Table) bool {
+	matchAny := args["x-match"] == "any"
+	matched, total := 0, 0
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		total++
+		if h, ok := headers[k]; ok && reflect.DeepEqual(normalizeArg(h), normalizeArg(v)) {
+			matched++
+		}
+	}
+	if matchAny {
+		return matched > 0
+	}
+	return matched == total
+}
+
+// sameArgs 比较声明参数, 整数按数值比较
+func sameArgs(a, b amqp.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		w, ok := b[k]
+		if !ok || !reflect.DeepEqual(normalizeArg(v), normalizeArg(w)) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeArg 整数统一为int64
+func normalizeArg(v interface{}) interface{} {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		return toInt64(v)
+	}
+	return v
+}
+
+// copyTable 浅拷贝 amqp.Table
+func copyTable(t amqp.Table) amqp.Table {
+	c := make(amqp.Table, len(t)+1)
+	for k, v := range t {
+		c[k] = v
+	}
+	return c
+}
+
+// xDeath 更新 x-death header, 同一队列同一原因的记录累加次数并移到最前
+func xDeath(v interface{}, queue, reason string, m *memoryMessage) []interface{} {
+	deaths, _ := v.([]interface{})
+	entry := amqp.Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     m.exchange,
+		"routing-keys": []interface{}{m.key},
+	}
+	list := []interface{}{entry}
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && t["queue"] == queue && t["reason"] == reason {
+			entry["count"] = toInt64(t["count"]) + 1
+			continue
+		}
+		list = append(list, d)
+	}
+	return list
+}
+
+// messageTTL 队列TTL与消息Expiration中较小的一个
+func messageTTL(q *memoryQueue, msg amqp.Publishing) (time.Duration, bool) {
+	var ttl time.Duration
+	ok := false
+	if v, has := q.args["x-message-ttl"]; has {
+		ttl, ok = time.Duration(toInt64(v))*time.Millisecond, true
+	}
+	if msg.Expiration != "" {
+		if ms, err := strconv.ParseInt(msg.Expiration, 10, 64); err == nil {
+			d := time.Duration(ms) * time.Millisecond
+			if !ok || d < ttl {
+				ttl, ok = d, true
+			}
+		}
+	}
+	return ttl, ok
+}
+
+// priority 不超过队列最大优先级的消息优先级
+func (m *memoryMessage) priority(max int64) int64 {
+	p := int64(m.msg.Priority)
+	if p > max {
+		return max
+	}
+	return p
+}
+
+// delivery 转换为投递的消息
+func (m *memoryMessage) delivery() amqp.Delivery {
+	return amqp.Delivery{
+		Headers:         copyTable(m.msg.Headers),
+		ContentType:     m.msg.ContentType,
+		ContentEncoding: m.msg.ContentEncoding,
+		DeliveryMode:    m.msg.DeliveryMode,
+		Priority:        m.msg.Priority,
+		CorrelationId:   m.msg.CorrelationId,
+		ReplyTo:         m.msg.ReplyTo,
+		Expiration:      m.msg.Expiration,
+		MessageId:       m.msg.MessageId,
+		Timestamp:       m.msg.Timestamp,
+		Type:            m.msg.Type,
+		UserId:          m.msg.UserId,
+		AppId:           m.msg.AppId,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            m.msg.Body,
+	}
+}
+
+// memoryConsumer 内存broker的消费者, 通过独立协程将消息写入 out, 分发时不会阻塞broker
+type memoryConsumer struct {
+	ch       *memoryChannel
+	queue    *memoryQueue
+	tag      string
+	autoAck  bool
+	prefetch int
+	inflight int // 由 broker.mu 保护
+
+	mu   sync.Mutex
+	buf  []amqp.Delivery
+	wake chan struct{}
+	stop chan struct{}
+	out  chan amqp.Delivery
+}
+
+// push 追加待写出的消息
+func (c *memoryConsumer) push(d amqp.Delivery) {
+	c.mu.Lock()
+	c.buf = append(c.buf, d)
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run 将消息依次写入 out, 消费者被取消后关闭 out
+func (c *memoryConsumer) run() {
+	defer close(c.out)
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		c.mu.Lock()
+		if len(c.buf) == 0 {
+			c.mu.Unlock()
+			select {
+			case <-c.wake:
+				continue
+			case <-c.stop:
+				return
+			}
+		}
+		d := c.buf[0]
+		c.buf = c.buf[1:]
+		c.mu.Unlock()
+		select {
+		case c.out <- d:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// memoryUnacked 已投递未确认的消息
+type memoryUnacked struct {
+	queue    *memoryQueue
+	msg      *memoryMessage
+	consumer *memoryConsumer // 通过 Get 获取时为nil
+}
+
+// memoryChannel 内存broker的管道, 实现内部的 channel 接口与 amqp.Acknowledger
+// 与AMQP一致, 操作失败(如 NOT_FOUND、PRECONDITION_FAILED)后管道会被关闭
+type memoryChannel struct {
+	b *MemoryBroker
+
+	// 以下字段由 b.mu 保护
+	closed    bool
+	prefetch  int
+	nextTag   uint64
+	unacked   map[uint64]memoryUnacked
+	consumers map[string]*memoryConsumer
+
+	notifyMu     sync.Mutex
+	notifyClosed bool
+	confirm      bool
+	publishSeq   uint64
+	confirms     []chan amqp.Confirmation
+	returns      []chan amqp.Return
+	closes       []chan *amqp.Error
+}
+
+var (
+	_ channel           = (*memoryChannel)(nil)
+	_ amqp.Acknowledger = (*memoryChannel)(nil)
+)
+
+// do 在broker锁内执行操作, 返回错误时关闭管道
+func (ch *memoryChannel) do(fn func(b *MemoryBroker) *amqp.Error) error {
+	b := ch.b
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	err := fn(b)
+	b.mu.Unlock()
+	if err != nil {
+		_ = ch.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+// deliver 生成投递消息, 非自动确认时记录为未确认
+func (ch *memoryChannel) deliver(q *memoryQueue, m *memoryMessage, c *memoryConsumer, autoAck bool) amqp.Delivery {
+	ch.nextTag++
+	d := m.delivery()
+	d.Acknowledger = ch
+	d.DeliveryTag = ch.nextTag
+	d.MessageCount = uint32(len(q.ready))
+	if !autoAck {
+		ch.unacked[ch.nextTag] = memoryUnacked{queue: q, msg: m, consumer: c}
+		q.unacked++
+		if c != nil {
+			c.inflight++
+		}
+	}
+	return d
+}
+
+// ExchangeDeclare 声明交换机, 已存在且类型不同时返回 PRECONDITION_FAILED
+func (ch *memoryChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return ch.exchangeDeclare(name, kind, false)
+}
+
+// ExchangeDeclarePassive 检查交换机是否存在, 不存在时返回 NOT_FOUND
+func (ch *memoryChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return ch.exchangeDeclare(name, kind, true)
+}
+
+func (ch *memoryChannel) exchangeDeclare(name, kind string, passive bool) error {
+	return ch.do(func(b *MemoryBroker) *amqp.Error {
+		if name == "" {
+			return &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED - operation not permitted on the default exchange", Server: true}
+		}
+		e, ok := b.exchanges[name]
+		switch {
+		case !passive && !memoryExchangeKind(kind):
+			// 不支持插件提供的交换机类型, 如 x-delayed-message
+			return &amqp.Error{Code: amqp.CommandInvalid, Reason: fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind), Server: true}
+		case ok && !passive && e.kind != kind:
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s'", name), Server: true}
+		case !ok && passive:
+			return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", name), Server: true}
+		case !ok:
+			b.exchanges[name] = &memoryExchange{name: name, kind: kind}
+		}
+		return nil
+	})
+}
+
+// ExchangeDelete 删除交换机及其绑定
+func (ch *memoryChannel) ExchangeDelete(name string, ifUnused, noWait bool) error {
+	return ch.do(func(b *MemoryBroker) *amqp.Error {
+		e, ok := b.exchanges[name]
+		if !ok {
+			return nil
+		}
+		if ifUnused && len(e.bindings) > 0 {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - exchange '%s' in use", name), Server: true}
+		}
+		delete(b.exchanges, name)
+		return nil
+	})
+}
+
+// memoryExchangeKind 内存broker支持的交换机类型
+func memoryExchangeKind(kind string) bool {
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+		return true
+	}
+	return false
+}
+
+// QueueDeclare 声明队列, name 为空时由broker生成, 已存在且参数不同时返回 PRECONDITION_FAILED
+func (ch *memoryChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return ch.queueDeclare(name, exclusive, args, false)
+}
+
+// QueueDeclarePassive 检查队列是否存在, 不存在时返回 NOT_FOUND
+func (ch *memoryChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return ch.queueDeclare(name, exclusive, args, true)
+}
+
+// QueueInspect 查看队列状态
+func (ch *memoryChannel) QueueInspect(name string) (amqp.Queue, error) {
+	return ch.queueDeclare(name, false, nil, true)
+}
+
+func (ch *memoryChannel) queueDeclare(name string, exclusive bool, args amqp.Table, passive bool) (amqp.Queue, error) {
+	var result amqp.Queue
+	err := ch.do(func(b *MemoryBroker) *amqp.Error {
+		if name == "" && !passive {
+			b.seq++
+			name = fmt.Sprintf("amq.gen-memory-%d", b.seq)
+		}
+		q, ok := b.queues[name]
+		switch {
+		case ok && !passive && !sameArgs(q.args, args):
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name), Server: true}
+		case !ok && passive:
+			return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name), Server: true}
+		case !ok:
+			q = &memoryQueue{name: name, args: copyTable(args)}
+			if exclusive {
+				q.owner = ch
+			}
+			b.queues[name] = q
+		}
+		result = amqp.Queue{Name: name, Messages: len(q.ready), Consumers: len(q.consumers)}
+		return nil
+	})
+	return result, err
+}
+
+// QueueBind 绑定队列与交换机
+func (ch *memoryChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return ch.do(func(b *MemoryBroker) *amqp.Error {
+		if exchange == "" {
+			return &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED - operation not permitted on the default exchange", Server: true}
+		}
+		e, ok := b.exchanges[exchange]
+		if !ok {
+			return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange), Server: true}
+		}
+		if _, ok := b.queues[name]; !ok {
+			return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name), Server: true}
+		}
+		for _, bind := range e.bindings {
+			if bind.queue == name && bind.key == key && sameArgs(bind.args, args) {
+				return nil
+			}
+		}
+		e.bindings = append(e.bindings, memoryBinding{queue: name, key: key, args: copyTable(args)})
+		return nil
+	})
+}
+
+// QueuePurge 清空队列中待投递的消息, 返回清除的数量
+func (ch *memoryChannel) QueuePurge(name string, noWait bool) (int, error) {
+	n := 0
+	err := ch.do(func(b *MemoryBroker) *amqp.Error {
+		q, ok := b.queues[name]
+		if !ok {
+			return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name), Server: true}
+		}
+		n = len(q.ready)
+		q.ready = nil
+		return nil
+	})
+	return n, err
+}
+
+// Qos 设置之后创建的消费者的预取数量, 0 表示不限制
+func (ch *memoryChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return ch.do(func(b *MemoryBroker) *amqp.Error {
+		ch.prefetch = prefetchCount
+		return nil
+	})
+}
+
+// Consume 开始消费, 管道关闭或取消消费后返回的chan会被关闭
+func (ch *memoryChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	var c *memoryConsumer
+	err := ch.do(func(b *MemoryBroker) *amqp.Error {
+		q, ok := b.queues[queue]
+		if !ok {
+			return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue), Server: true}
+		}
+		if consumer == "" {
+			b.seq++
+			consumer = fmt.Sprintf("ctag-memory-%d", b.seq)
+		}
+		if _, ok := ch.consumers[consumer]; ok {
+			return &amqp.Error{Code: amqp.NotAllowed, Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer), Server: true}
+		}
+		c = &memoryConsumer{
+			ch:       ch,
+			queue:    q,
+			tag:      consumer,
+			autoAck:  autoAck,
+			prefetch: ch.prefetch,
+			wake:     make(chan struct{}, 1),
+			stop:     make(chan struct{}),
+			out:      make(chan amqp.Delivery),
+		}
+		go c.run()
+		ch.consumers[consumer] = c
+		q.consumers = append(q.consumers, c)
+		b.dispatch(q)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.out, nil
+}
+
+// Cancel 取消消费, 已投递未确认的消息在管道关闭后回到队列
+func (ch *memoryChannel) Cancel(consumer string, noWait bool) error {
+	return ch.do(func(b *MemoryBroker) *amqp.Error {
+		if c, ok := ch.consumers[consumer]; ok {
+			b.removeConsumer(c)
+			b.dispatch(c.queue)
+		}
+		return nil
+	})
+}
+
+// Get 主动获取一条消息, 队列为空时 ok 为false
+func (ch *memoryChannel) Get(queue string, autoAck bool) (msg amqp.Delivery, ok bool, err error) {
+	err = ch.do(func(b *MemoryBroker) *amqp.Error {
+		q, exists := b.queues[queue]
+		if !exists {
+			return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue), Server: true}
+		}
+		if len(q.ready) == 0 {
+			return nil
+		}
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		msg, ok = ch.deliver(q, m, nil, autoAck), true
+		return nil
+	})
+	return
+}
+
+// Publish 发布消息, 开启confirm后通过 NotifyPublish 返回确认, mandatory 且无法路由时通过 NotifyReturn 退回
+func (ch *memoryChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	routed, ack := false, true
+	err := ch.do(func(b *MemoryBroker) *amqp.Error {
+		msg.Headers = copyTable(msg.Headers)
+		queues, err := b.route(exchange, key, msg.Headers)
+		if err != nil {
+			return err
+		}
+		routed = len(queues) > 0
+		for _, q := range queues {
+			if !b.enqueue(q, &memoryMessage{msg: msg, exchange: exchange, key: key}) {
+				ack = false
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	if ch.notifyClosed {
+		return nil
+	}
+	// 与broker一致, 先退回再确认
+	if mandatory && !routed {
+		r := amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+		for _, c := range ch.returns {
+			c <- r
+		}
+	}
+	if ch.confirm {
+		ch.publishSeq++
+		for _, c := range ch.confirms {
+			c <- amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: ack}
+		}
+	}
+	return nil
+}
+
+// Confirm 开启publisher confirm
+func (ch *memoryChannel) Confirm(noWait bool) error {
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	if ch.notifyClosed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+	return nil
+}
+
+// NotifyPublish 注册confirm监听
+func (ch *memoryChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	if ch.notifyClosed {
+		close(confirm)
+	} else {
+		ch.confirms = append(ch.confirms, confirm)
+	}
+	return confirm
+}
+
+// NotifyReturn 注册退回监听
+func (ch *memoryChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	if ch.notifyClosed {
+		close(c)
+	} else {
+		ch.returns = append(ch.returns, c)
+	}
+	return c
+}
+
+// NotifyClose 注册关闭监听, 异常关闭时先发送原因再关闭chan
+func (ch *memoryChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	if ch.notifyClosed {
+		close(c)
+	} else {
+		ch.closes = append(ch.closes, c)
+	}
+	return c
+}
+
+// Ack amqp.Acknowledger接口实现
+func (ch *memoryChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(b *MemoryBroker, u memoryUnacked) {})
+}
+
+// Nack amqp.Acknowledger接口实现, requeue 为false时进入死信
+func (ch *memoryChannel) Nack(tag uint64, multiple, requeue bool) error {
+	return ch.settle(tag, multiple, func(b *MemoryBroker, u memoryUnacked) {
+		if requeue {
+			b.requeue(u.queue, u.msg)
+		} else {
+			b.deadLetter(u.queue, u.msg, "rejected")
+		}
+	})
+}
+
+// Reject amqp.Acknowledger接口实现
+func (ch *memoryChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// settle 确认或拒绝消息, 按投递顺序倒序处理, 保证放回队列后顺序不变
+func (ch *memoryChannel) settle(tag uint64, multiple bool, fn func(b *MemoryBroker, u memoryUnacked)) error {
+	return ch.do(func(b *MemoryBroker) *amqp.Error {
+		tags := make([]uint64, 0, 1)
+		if multiple {
+			for t := range ch.unacked {
+				if t <= tag {
+					tags = append(tags, t)
+				}
+			}
+		} else if _, ok := ch.unacked[tag]; ok {
+			tags = append(tags, tag)
+		}
+		if len(tags) == 0 && !(multiple && tag == 0) {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag), Server: true}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+		touched := make(map[*memoryQueue]bool)
+		for _, t := range tags {
+			u := ch.unacked[t]
+			delete(ch.unacked, t)
+			u.queue.unacked--
+			if u.consumer != nil {
+				u.consumer.inflight--
+			}
+			fn(b, u)
+			touched[u.queue] = true
+		}
+		for q := range touched {
+			b.dispatch(q)
+		}
+		return nil
+	})
+}
+
+// Close 关闭管道, 未确认的消息回到队列
+func (ch *memoryChannel) Close() error {
+	return ch.shutdown(nil)
+}
+
+// shutdown 关闭管道, reason 不为空时通知关闭原因
+func (ch *memoryChannel) shutdown(reason *amqp.Error) error {
+	b := ch.b
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	ch.closed = true
+	delete(b.channels, ch)
+	touched := make(map[*memoryQueue]bool)
+	for _, c := range ch.consumers {
+		b.removeConsumer(c)
+		touched[c.queue] = true
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for t := range ch.unacked {
+		tags = append(tags, t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, t := range tags {
+		u := ch.unacked[t]
+		u.queue.unacked--
+		b.requeue(u.queue, u.msg)
+		touched[u.queue] = true
+	}
+	ch.unacked = nil
+	for _, q := range b.queues {
+		if q.owner == ch {
+			b.deleteQueue(q)
+			delete(touched, q)
+		}
+	}
+	if !b.closed {
+		for q := range touched {
+			b.dispatch(q)
+		}
+	}
+	b.mu.Unlock()
+
+	ch.notifyMu.Lock()
+	ch.notifyClosed = true
+	for _, c := range ch.closes {
+		if reason != nil {
+			c <- reason
+		}
+		close(c)
+	}
+	for _, c := range ch.confirms {
+		close(c)
+	}
+	for _, c := range ch.returns {
+		close(c)
+	}
+	ch.closes, ch.confirms, ch.returns = nil, nil, nil
+	ch.notifyMu.Unlock()
+	return nil
+}
@@ -0,0 +1,426 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// testReceiver 记录收到的消息, handle 为空时处理成功
+type testReceiver struct {
+	qe     QueueExchange
+	handle func(d amqp.Delivery) error
+
+	mu       sync.Mutex
+	got      []amqp.Delivery
+	at       []time.Time
+	failures []error
+}
+
+func (r *testReceiver) Options() QueueExchange    { return r.qe }
+func (r *testReceiver) Consumer([]byte) error     { return nil }
+func (r *testReceiver) Send(...interface{}) error { return nil }
+func (r *testReceiver) Recv(int)                  {}
+func (r *testReceiver) FailAction(err error, _ []byte) error {
+	r.mu.Lock()
+	r.failures = append(r.failures, err)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *testReceiver) ConsumeDelivery(_ context.Context, d amqp.Delivery) error {
+	r.mu.Lock()
+	r.got = append(r.got, d)
+	r.at = append(r.at, time.Now())
+	r.mu.Unlock()
+	if r.handle != nil {
+		return r.handle(d)
+	}
+	return nil
+}
+
+func (r *testReceiver) deliveries() []amqp.Delivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]amqp.Delivery{}, r.got...)
+}
+
+func (r *testReceiver) bodies() []string {
+	list := make([]string, 0)
+	for _, d := range r.deliveries() {
+		list = append(list, string(d.Body))
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (r *testReceiver) failed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.failures)
+}
+
+// newTestBroker 每个测试独立的内存broker
+func newTestBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+	b := NewMemoryBroker(t.Name())
+	t.Cleanup(b.Close)
+	return b
+}
+
+// startRecv 通过 RecvCtx 启动消费者, 测试结束时优雅退出
+func startRecv(t *testing.T, r *testReceiver, runNums int) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = RecvCtx(ctx, r.qe, r, runNums)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitFor 等待条件成立, 超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMemoryBrokerSendRecv(t *testing.T) {
+	b := newTestBroker(t)
+	qe := QueueExchange{QuName: "order", ExName: "order_ex", ExType: amqp.ExchangeDirect, RtKey: "order", Dns: b.DNS()}
+	r := &testReceiver{qe: qe}
+	startRecv(t, r, 1)
+
+	for _, body := range []string{"1", "2", "3"} {
+		if err := Send(qe, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "3 messages", func() bool { return len(r.deliveries()) == 3 })
+	if got := r.bodies(); !reflect.DeepEqual(got, []string{"1", "2", "3"}) {
+		t.Fatalf("bodies = %v", got)
+	}
+	waitFor(t, "acks", func() bool {
+		ready, unacked := b.QueueDepth("order")
+		return ready == 0 && unacked == 0
+	})
+}
+
+func TestMemoryBrokerRouting(t *testing.T) {
+	type publish struct {
+		key        string
+		headers    amqp.Table
+		body       string
+		unroutable bool
+	}
+	tests := []struct {
+		name     string
+		kind     string
+		bindings []BindingSpec
+		publish  []publish
+		want     map[string][]string
+	}{
+		{
+			name: "direct",
+			kind: amqp.ExchangeDirect,
+			bindings: []BindingSpec{
+				{Queue: "q1", RoutingKeys: []string{"a"}},
+				{Queue: "q2", RoutingKeys: []string{"a", "b"}},
+			},
+			publish: []publish{
+				{key: "a", body: "m1"},
+				{key: "b", body: "m2"},
+				{key: "c", body: "m3", unroutable: true},
+			},
+			want: map[string][]string{"q1": {"m1"}, "q2": {"m1", "m2"}},
+		},
+		{
+			name:     "fanout",
+			kind:     amqp.ExchangeFanout,
+			bindings: []BindingSpec{{Queue: "q1"}, {Queue: "q2"}},
+			publish:  []publish{{key: "ignored", body: "m1"}, {body: "m2"}},
+			want:     map[string][]string{"q1": {"m1", "m2"}, "q2": {"m1", "m2"}},
+		},
+		{
+			name: "topic",
+			kind: amqp.ExchangeTopic,
+			bindings: []BindingSpec{
+				{Queue: "q1", RoutingKeys: []string{"order.*"}},
+				{Queue: "q2", RoutingKeys: []string{"order.#"}},
+				{Queue: "q3", RoutingKeys: []string{"*.created"}},
+			},
+			publish: []publish{
+				{key: "order.created", body: "m1"},
+				{key: "order.eu.created", body: "m2"},
+				{key: "order", body: "m3"},
+				{key: "user.created", body: "m4"},
+				{key: "user.eu.created", body: "m5", unroutable: true},
+			},
+			want: map[string][]string{"q1": {"m1"}, "q2": {"m1", "m2", "m3"}, "q3": {"m1", "m4"}},
+		},
+		{
+			name: "headers",
+			kind: amqp.ExchangeHeaders,
+			bindings: []BindingSpec{
+				{Queue: "q1", Headers: map[string]interface{}{"type": "a", "region": "eu"}, Match: "all"},
+				{Queue: "q2", Headers: map[string]interface{}{"type": "a", "region": "us"}, Match: "any"},
+			},
+			publish: []publish{
+				{headers: amqp.Table{"type": "a", "region": "eu"}, body: "m1"},
+				{headers: amqp.Table{"type": "b", "region": "us"}, body: "m2"},
+				{headers: amqp.Table{"type": "a"}, body: "m3"},
+				{headers: amqp.Table{"type": "c"}, body: "m4", unroutable: true},
+			},
+			want: map[string][]string{"q1": {"m1"}, "q2": {"m1", "m2", "m3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			topo := &Topology{Exchanges: []ExchangeSpec{{Name: "ex", Type: tt.kind}}}
+			for _, bind := range tt.bindings {
+				bind.Exchange = "ex"
+				topo.Queues = append(topo.Queues, QueueSpec{Name: bind.Queue})
+				topo.Bindings = append(topo.Bindings, bind)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			if err := topo.Apply(ctx, b.DNS()); err != nil {
+				t.Fatal(err)
+			}
+
+			receivers := make(map[string]*testReceiver)
+			for queue := range tt.want {
+				r := &testReceiver{qe: QueueExchange{QuName: queue, Dns: b.DNS(), SkipDeclare: true}}
+				receivers[queue] = r
+				startRecv(t, r, 1)
+			}
+			for _, p := range tt.publish {
+				err := SendTo(ctx, b.DNS(), "ex", p.key, []byte(p.body), WithHeaders(p.headers))
+				if p.unroutable != errors.Is(err, ErrUnroutable) {
+					t.Fatalf("publish %q: err = %v, unroutable = %t", p.body, err, p.unroutable)
+				}
+			}
+
+			for queue, want := range tt.want {
+				r := receivers[queue]
+				waitFor(t, queue, func() bool { return len(r.deliveries()) >= len(want) })
+			}
+			// 等待可能多余的投递
+			time.Sleep(50 * time.Millisecond)
+			for queue, want := range tt.want {
+				if got := receivers[queue].bodies(); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s got %v, want %v", queue, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerFailureHandling(t *testing.T) {
+	errFail := errors.New("fail")
+	tests := []struct {
+		name        string
+		handle      func(n int) error // n 为第几次投递, 从1开始
+		deliveries  int
+		redelivered bool
+		parked      int
+		failActions int
+	}{
+		{name: "ack", handle: func(int) error { return nil }, deliveries: 1},
+		{
+			name: "requeue",
+			handle: func(n int) error {
+				if n == 1 {
+					return Requeue(errFail)
+				}
+				return nil
+			},
+			deliveries:  2,
+			redelivered: true,
+		},
+		{name: "permanent", handle: func(int) error { return Permanent(errFail) }, deliveries: 1, parked: 1, failActions: 1},
+		{
+			// 默认策略重试3次, 延迟重新投递超过3次也不会停放
+			name: "defer",
+			handle: func(n int) error {
+				if n <= 4 {
+					return Defer(errFail, 20*time.Millisecond)
+				}
+				return nil
+			},
+			deliveries: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			qe := QueueExchange{QuName: "job", Dns: b.DNS()}
+			r := &testReceiver{qe: qe}
+			r.handle = func(amqp.Delivery) error { return tt.handle(len(r.deliveries())) }
+			startRecv(t, r, 1)
+
+			if err := Send(qe, "payload"); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "deliveries", func() bool { return len(r.deliveries()) >= tt.deliveries })
+			waitFor(t, "queue drained", func() bool {
+				ready, unacked := b.QueueDepth("job")
+				return ready == 0 && unacked == 0
+			})
+			time.Sleep(20 * time.Millisecond)
+
+			list := r.deliveries()
+			if len(list) != tt.deliveries {
+				t.Fatalf("deliveries = %d, want %d", len(list), tt.deliveries)
+			}
+			if got := list[len(list)-1].Redelivered; got != tt.redelivered {
+				t.Errorf("redelivered = %t, want %t", got, tt.redelivered)
+			}
+			if ready, _ := b.QueueDepth(ParkingQueueName(qe)); ready != tt.parked {
+				t.Errorf("parked = %d, want %d", ready, tt.parked)
+			}
+			if got := r.failed(); got != tt.failActions {
+				t.Errorf("FailAction calls = %d, want %d", got, tt.failActions)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerRetryTiers(t *testing.T) {
+	b := newTestBroker(t)
+	qe := QueueExchange{
+		QuName: "job",
+		ExName: "job_ex",
+		ExType: amqp.ExchangeDirect,
+		RtKey:  "job",
+		Dns:    b.DNS(),
+		Retry:  &RetryPolicy{MaxAttempts: 2, Backoff: []time.Duration{50 * time.Millisecond, 100 * time.Millisecond}},
+	}
+	r := &testReceiver{qe: qe, handle: func(amqp.Delivery) error { return errors.New("fail") }}
+	startRecv(t, r, 1)
+
+	if err := Send(qe, "payload"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "parking", func() bool {
+		ready, _ := b.QueueDepth(ParkingQueueName(qe))
+		return ready == 1
+	})
+
+	list := r.deliveries()
+	if len(list) != 3 {
+		t.Fatalf("deliveries = %d, want 3", len(list))
+	}
+	for i, d := range list {
+		if got := retryCount(d); got != int32(i) {
+			t.Errorf("delivery %d retry_nums = %d", i, got)
+		}
+	}
+	r.mu.Lock()
+	gaps := []time.Duration{r.at[1].Sub(r.at[0]), r.at[2].Sub(r.at[1])}
+	r.mu.Unlock()
+	for i, want := range qe.Retry.Backoff {
+		if gaps[i] < want {
+			t.Errorf("retry %d after %s, want at least %s", i+1, gaps[i], want)
+		}
+	}
+	for _, queue := range []string{"job_retry_50ms", "job_retry_100ms"} {
+		if ready, unacked := b.QueueDepth(queue); ready != 0 || unacked != 0 {
+			t.Errorf("%s not drained: %d/%d", queue, ready, unacked)
+		}
+	}
+	parked := b.Messages(ParkingQueueName(qe))
+	if got := retryCount(parked[0]); got != 2 {
+		t.Errorf("parked retry_nums = %d, want 2", got)
+	}
+	if got := r.failed(); got != 1 {
+		t.Errorf("FailAction calls = %d, want 1", got)
+	}
+}
+
+func TestMemoryBrokerRetryFanout(t *testing.T) {
+	// 重试消息只回到失败的队列, 不会复制给同一 fanout 交换机上的其他队列
+	b := newTestBroker(t)
+	retry := &RetryPolicy{MaxAttempts: 3, Backoff: []time.Duration{20 * time.Millisecond}}
+	failing := &testReceiver{qe: QueueExchange{QuName: "a", ExName: "fan", ExType: amqp.ExchangeFanout, RtKey: "all", Dns: b.DNS(), Retry: retry}}
+	failing.handle = func(amqp.Delivery) error {
+		if len(failing.deliveries()) == 1 {
+			return errors.New("fail")
+		}
+		return nil
+	}
+	other := &testReceiver{qe: QueueExchange{QuName: "b", ExName: "fan", ExType: amqp.ExchangeFanout, RtKey: "all", Dns: b.DNS()}}
+	startRecv(t, failing, 1)
+	startRecv(t, other, 1)
+	waitFor(t, "queues declared", func() bool { return reflect.DeepEqual(b.Queues(), []string{"a", "b"}) })
+
+	if err := Send(failing.qe, "payload"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "retry", func() bool { return len(failing.deliveries()) == 2 })
+	time.Sleep(100 * time.Millisecond)
+	if got := len(failing.deliveries()); got != 2 {
+		t.Errorf("a deliveries = %d, want 2", got)
+	}
+	if got := len(other.deliveries()); got != 1 {
+		t.Errorf("b deliveries = %d, want 1", got)
+	}
+}
+
+func TestMemoryBrokerPrefetch(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefetch int
+		runNums  int
+		unacked  int
+	}{
+		{name: "default", prefetch: 0, runNums: 1, unacked: 1},
+		{name: "prefetch 3", prefetch: 3, runNums: 1, unacked: 3},
+		{name: "2 workers prefetch 2", prefetch: 2, runNums: 2, unacked: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			qe := QueueExchange{QuName: "slow", Dns: b.DNS(), Prefetch: tt.prefetch}
+			release := make(chan struct{})
+			r := &testReceiver{qe: qe, handle: func(amqp.Delivery) error {
+				<-release
+				return nil
+			}}
+			for i := 0; i < 10; i++ {
+				if err := Send(qe, "payload"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			startRecv(t, r, tt.runNums)
+			waitFor(t, "handlers busy", func() bool { return len(r.deliveries()) == tt.runNums })
+			waitFor(t, "prefetch", func() bool {
+				_, unacked := b.QueueDepth("slow")
+				return unacked == tt.unacked
+			})
+			time.Sleep(20 * time.Millisecond)
+			if ready, unacked := b.QueueDepth("slow"); unacked != tt.unacked || ready != 10-tt.unacked {
+				t.Errorf("ready/unacked = %d/%d, want %d/%d", ready, unacked, 10-tt.unacked, tt.unacked)
+			}
+			close(release)
+			waitFor(t, "all consumed", func() bool { return len(r.deliveries()) == 10 })
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package rabbitmq
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsCollector 消费与发布指标的采集接口, 默认为 DefaultMetrics
+// 使用其他监控系统时可自行实现并通过 SetMetricsCollector 替换
+type MetricsCollector interface {
+	MessageConsumed(queue string, lag time.Duration)            // 收到消息, lag 为消息生成到被消费的时间, 未知时为0
+	MessageAcked(queue string, n int)                           // 确认消息
+	MessageRetried(queue string)                                // 投递到重试队列
+	MessageParked(queue string)                                 // 投递到停放队列
+	MessageRequeued(queue string)                               // 拒绝并重新入队
+	ObserveHandler(queue string, d time.Duration, err error)    // 处理函数耗时
+	ObservePublish(exchange string, d time.Duration, err error) // 发布并等待确认的耗时
+	SetQueueDepth(queue string, messages, consumers int)        // 队列消息数量与消费者数量
+	SetSpoolDepth(addr string, pending, bytes int64)            // 本地缓存待发布的消息数量与大小
+}
+
+// DefaultMetrics 默认的指标采集
+var DefaultMetrics = NewPrometheusMetrics("rabbitmq")
+
+// MetricsBuckets 处理与发布耗时直方图的分桶, 单位秒
+var MetricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// LagBuckets 消费延迟直方图的分桶, 单位秒
+var LagBuckets = []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// QueueDepthInterval 开启 QueueExchange.PollDepth 的消费者上报队列深度的间隔, 小于等于0时不上报
+var QueueDepthInterval = 15 * time.Second
+
+var collector atomic.Value
+
+func init() {
+	collector.Store(metricsHolder{DefaultMetrics})
+}
+
+// metricsHolder atomic.Value 要求存入的类型一致
+type metricsHolder struct {
+	MetricsCollector
+}
+
+// SetMetricsCollector 替换指标采集实现, 传入nil时关闭采集
+func SetMetricsCollector(c MetricsCollector) {
+	if c == nil {
+		c = noopMetrics{}
+	}
+	collector.Store(metricsHolder{c})
+}
+
+// metrics 当前的指标采集实现
+func metrics() MetricsCollector {
+	return collector.Load().(metricsHolder).MetricsCollector
+}
+
+// MetricsHandler 输出 DefaultMetrics 的HTTP处理函数, 挂载到 /metrics 供Prometheus抓取
+// 已有 prometheus.Registry 的项目也可直接注册 DefaultMetrics: prometheus.MustRegister(rabbitmq.DefaultMetrics)
+func MetricsHandler() http.Handler {
+	return DefaultMetrics
+}
+
+// PollQueueDepth 每隔 interval 被动声明队列, 上报消息数量与消费者数量, 直到ctx结束
+// 使用与生产者共享的连接, 队列不存在等错误只在首次出现或变化时记录日志
+func PollQueueDepth(ctx context.Context, dns string, interval time.Duration, queues ...string) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	lastErr := make(map[string]string, len(queues))
+	for {
+		for _, queue := range queues {
+			pctx, cancel := context.WithTimeout(ctx, interval)
+			q, err := InspectQueue(pctx, dns, queue)
+			cancel()
+			if err != nil {
+				if ctx.Err() == nil && lastErr[queue] != err.Error() {
+					log.Printf("[%s] 获取队列深度失败 :%s \n", queue, err)
+				}
+				lastErr[queue] = err.Error()
+				continue
+			}
+			delete(lastErr, queue)
+			metrics().SetQueueDepth(queue, q.Messages, q.Consumers)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// PrometheusMetrics 基于 prometheus/client_golang 的指标采集, 需通过 NewPrometheusMetrics 创建
+// 实现了 prometheus.Collector, 可注册到任意 Registry, 也可通过 ServeHTTP 单独输出
+type PrometheusMetrics struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	consumed   *prometheus.CounterVec
+	acked      *prometheus.CounterVec
+	retried    *prometheus.CounterVec
+	parked     *prometheus.CounterVec
+	requeued   *prometheus.CounterVec
+	lag        *prometheus.HistogramVec
+	duration   *prometheus.HistogramVec
+	publish    *prometheus.HistogramVec
+	messages   *prometheus.GaugeVec
+	consumers  *prometheus.GaugeVec
+	spoolCount *prometheus.GaugeVec
+	spoolBytes *prometheus.GaugeVec
+}
+
+// NewPrometheusMetrics 创建指标采集, namespace 为指标名前缀
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Name: name, Help: help}, labels)
+	}
+	histogram := func(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: namespace, Name: name, Help: help, Buckets: buckets}, labels)
+	}
+	gauge := func(name, help string, labels ...string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Name: name, Help: help}, labels)
+	}
+	m := &PrometheusMetrics{
+		registry:   prometheus.NewRegistry(),
+		consumed:   counter("consumed_total", "Messages delivered to consumers.", "queue"),
+		acked:      counter("acked_total", "Messages acknowledged by consumers.", "queue"),
+		retried:    counter("retried_total", "Messages published to a retry queue after a handler failure.", "queue"),
+		parked:     counter("parked_total", "Messages published to the parking queue after retries were exhausted.", "queue"),
+		requeued:   counter("requeued_total", "Messages rejected and requeued.", "queue"),
+		lag:        histogram("consume_lag_seconds", "Time from message timestamp to delivery.", LagBuckets, "queue"),
+		duration:   histogram("handler_duration_seconds", "Handler latency.", MetricsBuckets, "queue", "result"),
+		publish:    histogram("publish_duration_seconds", "Publish latency including broker confirm.", MetricsBuckets, "exchange", "result"),
+		messages:   gauge("queue_messages", "Messages ready in the queue.", "queue"),
+		consumers:  gauge("queue_consumers", "Consumers attached to the queue.", "queue"),
+		spoolCount: gauge("spool_pending", "Messages waiting in the local spool.", "addr"),
+		spoolBytes: gauge("spool_bytes", "Size of the local spool segment files.", "addr"),
+	}
+	m.registry.MustRegister(m)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// collectors 全部指标
+func (m *PrometheusMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.consumed, m.acked, m.retried, m.parked, m.requeued,
+		m.lag, m.duration, m.publish,
+		m.messages, m.consumers, m.spoolCount, m.spoolBytes,
+	}
+}
+
+// Describe prometheus.Collector接口实现
+func (m *PrometheusMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect prometheus.Collector接口实现
+func (m *PrometheusMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// ServeHTTP 实现 http.Handler, 输出Prometheus文本格式
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// MessageConsumed MetricsCollector接口实现
+func (m *PrometheusMetrics) MessageConsumed(queue string, lag time.Duration) {
+	m.consumed.WithLabelValues(queue).Inc()
+	if lag > 0 {
+		m.lag.WithLabelValues(queue).Observe(lag.Seconds())
+	}
+}
+
+// MessageAcked MetricsCollector接口实现
+func (m *PrometheusMetrics) MessageAcked(queue string, n int) {
+	m.acked.WithLabelValues(queue).Add(float64(n))
+}
+
+// MessageRetried MetricsCollector接口实现
+func (m *PrometheusMetrics) MessageRetried(queue string) {
+	m.retried.WithLabelValues(queue).Inc()
+}
+
+// MessageParked MetricsCollector接口实现
+func (m *PrometheusMetrics) MessageParked(queue string) {
+	m.parked.WithLabelValues(queue).Inc()
+}
+
+// MessageRequeued MetricsCollector接口实现
+func (m *PrometheusMetrics) MessageRequeued(queue string) {
+	m.requeued.WithLabelValues(queue).Inc()
+}
+
+// ObserveHandler MetricsCollector接口实现
+func (m *PrometheusMetrics) ObserveHandler(queue string, d time.Duration, err error) {
+	m.duration.WithLabelValues(queue, result(err)).Observe(d.Seconds())
+}
+
+// ObservePublish MetricsCollector接口实现, 默认交换机记为 amq.default
+func (m *PrometheusMetrics) ObservePublish(exchange string, d time.Duration, err error) {
+	if exchange == "" {
+		exchange = "amq.default"
+	}
+	m.publish.WithLabelValues(exchange, result(err)).Observe(d.Seconds())
+}
+
+// SetQueueDepth MetricsCollector接口实现
+func (m *PrometheusMetrics) SetQueueDepth(queue string, messages, consumers int) {
+	m.messages.WithLabelValues(queue).Set(float64(messages))
+	m.consumers.WithLabelValues(queue).Set(float64(consumers))
+}
+
+// SetSpoolDepth MetricsCollector接口实现
+func (m *PrometheusMetrics) SetSpoolDepth(addr string, pending, bytes int64) {
+	m.spoolCount.WithLabelValues(addr).Set(float64(pending))
+	m.spoolBytes.WithLabelValues(addr).Set(float64(bytes))
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// noopMetrics 关闭采集
+type noopMetrics struct{}
+
+func (noopMetrics) MessageConsumed(string, time.Duration)       {}
+func (noopMetrics) MessageAcked(string, int)                    {}
+func (noopMetrics) MessageRetried(string)                       {}
+func (noopMetrics) MessageParked(string)                        {}
+func (noopMetrics) MessageRequeued(string)                      {}
+func (noopMetrics) ObserveHandler(string, time.Duration, error) {}
+func (noopMetrics) ObservePublish(string, time.Duration, error) {}
+func (noopMetrics) SetQueueDepth(string, int, int)              {}
+func (noopMetrics) SetSpoolDepth(string, int64, int64)          {}
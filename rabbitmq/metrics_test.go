@@ -0,0 +1,91 @@
+package rabbitmq
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics("test")
+	m.MessageConsumed(`odd"queue`, 2*time.Second)
+	m.MessageAcked(`odd"queue`, 3)
+	m.ObserveHandler("orders", 20*time.Millisecond, nil)
+	m.ObserveHandler("orders", 20*time.Millisecond, errors.New("fail"))
+	m.ObservePublish("", time.Millisecond, nil)
+
+	want := `
+# HELP test_acked_total Messages acknowledged by consumers.
+# TYPE test_acked_total counter
+test_acked_total{queue="odd\"queue"} 3
+# HELP test_consumed_total Messages delivered to consumers.
+# TYPE test_consumed_total counter
+test_consumed_total{queue="odd\"queue"} 1
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want), "test_acked_total", "test_consumed_total"); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(m, "test_handler_duration_seconds"); n != 2 {
+		t.Fatalf("handler series = %d, want 2", n)
+	}
+
+	// HTTP输出可被Prometheus解析
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	families, err := new(expfmt.TextParser).TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := families["test_publish_duration_seconds"]
+	if publish == nil || publish.Metric[0].GetHistogram().GetSampleCount() != 1 {
+		t.Fatalf("publish histogram = %v", publish)
+	}
+	if got := publish.Metric[0].Label[0].GetValue(); got != "amq.default" {
+		t.Errorf("exchange label = %q", got)
+	}
+}
+
+// depthRecorder 记录上报的队列深度
+type depthRecorder struct {
+	noopMetrics
+	mu     sync.Mutex
+	queues map[string]int
+}
+
+func (r *depthRecorder) SetQueueDepth(queue string, _, _ int) {
+	r.mu.Lock()
+	r.queues[queue]++
+	r.mu.Unlock()
+}
+
+func (r *depthRecorder) count(queue string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queues[queue]
+}
+
+func TestQueueDepthPollingIsOptIn(t *testing.T) {
+	interval := QueueDepthInterval
+	QueueDepthInterval = 10 * time.Millisecond
+	rec := &depthRecorder{queues: make(map[string]int)}
+	SetMetricsCollector(rec)
+	defer func() {
+		QueueDepthInterval = interval
+		SetMetricsCollector(DefaultMetrics)
+	}()
+
+	b := newTestBroker(t)
+	startRecv(t, &testReceiver{qe: QueueExchange{QuName: "quiet", Dns: b.DNS()}}, 1)
+	startRecv(t, &testReceiver{qe: QueueExchange{QuName: "polled", Dns: b.DNS(), PollDepth: true}}, 1)
+
+	waitFor(t, "depth polling", func() bool { return rec.count("polled") >= 2 })
+	if n := rec.count("quiet"); n != 0 {
+		t.Errorf("queue without PollDepth polled %d times", n)
+	}
+}
@@ -0,0 +1,140 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Delivery 消费中的消息
+type Delivery struct {
+	amqp.Delivery
+	Queue     string // 消费的队列
+	RetryNums int32  // 已重试次数
+	Worker    int    // 消费协程编号
+}
+
+// HandlerFunc 消息处理函数, 返回错误时进入重试流程
+type HandlerFunc func(ctx context.Context, d *Delivery) error
+
+// Middleware 消费中间件
+type Middleware func(next HandlerFunc) HandlerFunc
+
+var (
+	middlewareMu      sync.RWMutex
+	globalMiddlewares []Middleware
+)
+
+// Use 注册全局消费中间件, 对之后启动的所有消费者生效, 按注册顺序由外到内执行
+func Use(mws ...Middleware) {
+	middlewareMu.Lock()
+	globalMiddlewares = append(globalMiddlewares, mws...)
+	middlewareMu.Unlock()
+}
+
+// middlewares 全局中间件副本
+func middlewares() []Middleware {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	return append([]Middleware{}, globalMiddlewares...)
+}
+
+// Chain 将多个中间件组合为一个, 第一个为最外层
+func Chain(mws ...Middleware) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// PanicError 消息处理时发生的panic
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error error接口实现
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("rabbitmq: handler panic: %v", e.Value)
+}
+
+// Recovery 捕获处理函数的panic并转为 *PanicError, 消息按失败进入重试流程
+// 消费者默认已在最外层使用
+func Recovery() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, d *Delivery) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = &PanicError{Value: r, Stack: debug.Stack()}
+					log.Printf("[%s#%d] 消息处理panic :%v \n%s", d.Queue, d.Worker, r, err.(*PanicError).Stack)
+				}
+			}()
+			return next(ctx, d)
+		}
+	}
+}
+
+// ErrHandlerTimeout 消息处理超时
+var ErrHandlerTimeout = errors.New("rabbitmq: handler timeout")
+
+// Timeout 单条消息的处理超时时间, 只设置ctx的截止时间, 不会启动新协程或强制中断处理函数
+// 只有监听 ctx.Done() 的处理函数才会在超时后结束, 不监听ctx的处理函数会一直执行到自行返回
+// 超时后仍等待处理函数返回, 不会在原处理仍在执行时重试
+// 超时后处理函数返回错误时返回 ErrHandlerTimeout 进入重试流程, 返回nil时按处理成功确认
+func Timeout(d time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, delivery *Delivery) error {
+			tctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			err := next(tctx, delivery)
+			if err != nil && ctx.Err() == nil && tctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("%w after %s: %v", ErrHandlerTimeout, d, err)
+			}
+			return err
+		}
+	}
+}
+
+// Logging 记录每条消息的处理结果与耗时, logger 为空时使用标准库默认logger
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, d *Delivery) error {
+			start := time.Now()
+			err := next(ctx, d)
+			elapsed := time.Since(start)
+			if err != nil {
+				logger.Printf("[%s#%d] message_id=%s retry_nums=%d elapsed=%s err=%s \n", d.Queue, d.Worker, d.MessageId, d.RetryNums, elapsed, err)
+			} else {
+				logger.Printf("[%s#%d] message_id=%s retry_nums=%d elapsed=%s ok \n", d.Queue, d.Worker, d.MessageId, d.RetryNums, elapsed)
+			}
+			return err
+		}
+	}
+}
+
+// Observer 处理结果观察函数, 用于对接监控指标
+type Observer func(d *Delivery, elapsed time.Duration, err error)
+
+// Metrics 每条消息处理完成后回调 observer, 可用于上报处理次数、失败次数与耗时
+func Metrics(observer Observer) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, d *Delivery) error {
+			start := time.Now()
+			err := next(ctx, d)
+			observer(d, time.Since(start), err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package rabbitmq
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PublishOption 发布消息时的可选属性
+type PublishOption func(*amqp.Publishing)
+
+// newPublishing 创建默认持久化的消息并应用可选属性
+func newPublishing(contentType string, body []byte, opts ...PublishOption) amqp.Publishing {
+	msg := amqp.Publishing{
+		ContentType:  contentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	}
+	applyOptions(&msg, opts)
+	return msg
+}
+
+// applyOptions 应用可选属性
+func applyOptions(msg *amqp.Publishing, opts []PublishOption) {
+	for _, opt := range opts {
+		opt(msg)
+	}
+}
+
+// WithTransient 非持久化消息, broker重启后丢失, 默认为持久化
+func WithTransient() PublishOption {
+	return func(p *amqp.Publishing) {
+		p.DeliveryMode = amqp.Transient
+	}
+}
+
+// WithDeliveryMode 设置投递模式 amqp.Persistent / amqp.Transient
+func WithDeliveryMode(mode uint8) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.DeliveryMode = mode
+	}
+}
+
+// WithPriority 消息优先级 0-9, 队列需要通过 QueueExchange.MaxPriority 开启优先级
+func WithPriority(priority uint8) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.Priority = priority
+	}
+}
+
+// WithTTL 单条消息的过期时间
+func WithTTL(ttl time.Duration) PublishOption {
+	return func(p *amqp.Publishing) {
+		ms := ttl.Milliseconds()
+		if ms < 0 {
+			ms = 0
+		}
+		p.Expiration = strconv.FormatInt(ms, 10)
+	}
+}
+
+// WithHeaders 追加自定义headers, 同名header会被覆盖
+func WithHeaders(headers amqp.Table) PublishOption {
+	return func(p *amqp.Publishing) {
+		table := make(amqp.Table, len(p.Headers)+len(headers))
+		for k, v := range p.Headers {
+			table[k] = v
+		}
+		for k, v := range headers {
+			table[k] = v
+		}
+		p.Headers = table
+	}
+}
+
+// WithHeader 追加单个自定义header
+func WithHeader(key string, value interface{}) PublishOption {
+	return WithHeaders(amqp.Table{key: value})
+}
+
+// WithMessageID 设置消息ID
+func WithMessageID(id string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.MessageId = id
+	}
+}
+
+// WithCorrelationID 设置关联ID
+func WithCorrelationID(id string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.CorrelationId = id
+	}
+}
+
+// WithAppID 设置应用ID
+func WithAppID(appId string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.AppId = appId
+	}
+}
+
+// WithContentType 设置 content-type, 默认为 text/plain
+func WithContentType(contentType string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.ContentType = contentType
+	}
+}
+
+// WithType 设置消息类型
+func WithType(msgType string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.Type = msgType
+	}
+}
+
+// WithTimestamp 设置消息时间
+func WithTimestamp(t time.Time) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.Timestamp = t
+	}
+}
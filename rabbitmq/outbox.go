@@ -0,0 +1,542 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/biwankaifa/go-util/db"
+	"github.com/streadway/amqp"
+	"gorm.io/gorm"
+)
+
+// OutboxTableName 发件箱表名
+var OutboxTableName = "rabbitmq_outbox"
+
+// OutboxStatus 发件箱消息状态
+type OutboxStatus int8
+
+const (
+	OutboxPending OutboxStatus = 0 // 待发布
+	OutboxSent    OutboxStatus = 1 // 已发布并收到broker确认
+	OutboxFailed  OutboxStatus = 2 // 超过最大尝试次数, 需要人工处理
+)
+
+// OutboxMessage 发件箱消息, 与业务数据在同一事务中写入, 由 OutboxRelay 异步发布
+type OutboxMessage struct {
+	ID            uint64       `gorm:"primaryKey;autoIncrement"`
+	MessageId     string       `gorm:"type:varchar(64);not null;uniqueIndex"`
+	QueueName     string       `gorm:"type:varchar(255);not null;default:''"`
+	RoutingKey    string       `gorm:"type:varchar(255);not null;default:''"`
+	ExchangeName  string       `gorm:"type:varchar(255);not null;default:''"`
+	ExchangeType  string       `gorm:"type:varchar(32);not null;default:''"`
+	QueueArgs     string       `gorm:"type:text"` // 声明队列的参数, JSON
+	SkipDeclare   bool         `gorm:"not null;default:false"`
+	ContentType   string       `gorm:"type:varchar(128);not null;default:''"`
+	MessageType   string       `gorm:"type:varchar(255);not null;default:''"`
+	CorrelationId string       `gorm:"type:varchar(255);not null;default:''"`
+	ReplyTo       string       `gorm:"type:varchar(255);not null;default:''"`
+	AppId         string       `gorm:"type:varchar(255);not null;default:''"`
+	Expiration    string       `gorm:"type:varchar(32);not null;default:''"`
+	DeliveryMode  uint8        `gorm:"not null;default:2"`
+	Priority      uint8        `gorm:"not null;default:0"`
+	Headers       string       `gorm:"type:text"` // JSON
+	Body          []byte       `gorm:"type:mediumblob"`
+	Status        OutboxStatus `gorm:"not null;default:0;index:idx_outbox_pending,priority:1"`
+	NextAttemptAt time.Time    `gorm:"not null;index:idx_outbox_pending,priority:2"`
+	Attempts      int          `gorm:"not null;default:0"`
+	LastError     string       `gorm:"type:varchar(1024);not null;default:''"`
+	LockedBy      *string      `gorm:"type:varchar(64);index"`
+	LockedUntil   *time.Time
+	ProducedAt    time.Time
+	SentAt        *time.Time `gorm:"index"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// TableName gorm表名
+func (OutboxMessage) TableName() string {
+	return OutboxTableName
+}
+
+// MigrateOutbox 创建或更新发件箱表
+func MigrateOutbox(tx *gorm.DB) error {
+	return tx.AutoMigrate(&OutboxMessage{})
+}
+
+// SaveOutbox 在调用方的事务中写入一条待发布的消息, 事务提交后由 OutboxRelay 发布
+// tx 一般为 db.Dbc(ctx).Transaction 回调中的 *gorm.DB, 事务回滚时消息一并回滚
+//
+//	err := db.Dbc(ctx).Transaction(func(tx *gorm.DB) error {
+//		if err := tx.Create(&order).Error; err != nil {
+//			return err
+//		}
+//		_, err := rabbitmq.SaveOutbox(tx, qe, body)
+//		return err
+//	})
+func SaveOutbox(tx *gorm.DB, queueExchange QueueExchange, msg string, opts ...PublishOption) (*OutboxMessage, error) {
+	return saveOutbox(tx, queueExchange, newPublishing(ContentTypeText, []byte(msg), opts...))
+}
+
+// SaveOutboxMessage 在调用方的事务中写入一条类型化消息, 事务提交后由 OutboxRelay 发布
+func SaveOutboxMessage(tx *gorm.DB, queueExchange QueueExchange, m Message, opts ...PublishOption) (*OutboxMessage, error) {
+	msg, err := m.publishing(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return saveOutbox(tx, queueExchange, msg)
+}
+
+// saveOutbox 写入发件箱, 消息ID为空时自动生成, 供消费者去重
+func saveOutbox(tx *gorm.DB, queueExchange QueueExchange, msg amqp.Publishing) (*OutboxMessage, error) {
+	if msg.MessageId == "" {
+		msg.MessageId = NewMessageID()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	headers := copyTable(msg.Headers)
+	// 发布时延续写入时的链路
+	if tx.Statement != nil && tx.Statement.Context != nil {
+		injectSpan(tx.Statement.Context, headers)
+	}
+	m, err := newOutboxMessage(queueExchange, msg, headers)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Create(m).Error; err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newOutboxMessage 将AMQP消息转换为发件箱记录
+func newOutboxMessage(queueExchange QueueExchange, msg amqp.Publishing, headers amqp.Table) (*OutboxMessage, error) {
+	t := queueTopology(queueExchange)
+	m := &OutboxMessage{
+		MessageId:     msg.MessageId,
+		QueueName:     queueExchange.QuName,
+		RoutingKey:    queueExchange.RtKey,
+		ExchangeName:  queueExchange.ExName,
+		ExchangeType:  queueExchange.ExType,
+		SkipDeclare:   queueExchange.SkipDeclare,
+		ContentType:   msg.ContentType,
+		MessageType:   msg.Type,
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		AppId:         msg.AppId,
+		Expiration:    msg.Expiration,
+		DeliveryMode:  msg.DeliveryMode,
+		Priority:      msg.Priority,
+		Body:          msg.Body,
+		Status:        OutboxPending,
+		NextAttemptAt: time.Now(),
+		ProducedAt:    msg.Timestamp,
+	}
+	var err error
+	if m.QueueArgs, err = encodeTable(t.queueArgs); err != nil {
+		return nil, err
+	}
+	if m.Headers, err = encodeTable(headers); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// topology 发布时声明的拓扑
+func (m *OutboxMessage) topology() (topology, error) {
+	args, err := decodeTable(m.QueueArgs)
+	if err != nil {
+		return topology{}, err
+	}
+	return topology{
+		exchange:     m.ExchangeName,
+		exchangeType: m.ExchangeType,
+		queue:        m.QueueName,
+		routingKey:   m.RoutingKey,
+		queueArgs:    args,
+		skip:         m.SkipDeclare,
+	}, nil
+}
+
+// publishing 还原为AMQP消息
+func (m *OutboxMessage) publishing() (amqp.Publishing, error) {
+	headers, err := decodeTable(m.Headers)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   m.ContentType,
+		DeliveryMode:  m.DeliveryMode,
+		Priority:      m.Priority,
+		CorrelationId: m.CorrelationId,
+		ReplyTo:       m.ReplyTo,
+		Expiration:    m.Expiration,
+		MessageId:     m.MessageId,
+		Timestamp:     m.ProducedAt,
+		Type:          m.MessageType,
+		AppId:         m.AppId,
+		Body:          m.Body,
+	}, nil
+}
+
+// encodeTable amqp.Table 编码为JSON, 时间等类型会转为字符串
+func encodeTable(t amqp.Table) (string, error) {
+	if len(t) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("rabbitmq: encode table: %w", err)
+	}
+	return string(b), nil
+}
+
+// decodeTable 解码JSON为 amqp.Table, 整数还原为int64
+func decodeTable(s string) (amqp.Table, error) {
+	if s == "" {
+		return nil, nil
+	}
+	d := json.NewDecoder(bytes.NewReader([]byte(s)))
+	d.UseNumber()
+	var v map[string]interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("rabbitmq: decode table: %w", err)
+	}
+	return normalizeJSON(v).(amqp.Table), nil
+}
+
+// normalizeJSON 将JSON解码结果转换为AMQP支持的类型
+func normalizeJSON(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		t := make(amqp.Table, len(x))
+		for k, item := range x {
+			t[k] = normalizeJSON(item)
+		}
+		return t
+	case []interface{}:
+		list := make([]interface{}, len(x))
+		for i, item := range x {
+			list[i] = normalizeJSON(item)
+		}
+		return list
+	case json.Number:
+		if n, err := x.Int64(); err == nil {
+			return n
+		}
+		f, _ := x.Float64()
+		return f
+	}
+	return v
+}
+
+// OutboxRelay 发件箱中继, 需通过 NewOutboxRelay 创建, 定时读取待发布的消息, 以confirm模式发布后标记为已发布
+// 多个实例可同时运行, 每批消息通过 locked_by/locked_until 租约认领, 实例异常退出后租约过期会被其他实例接管
+// 发布成功但更新状态失败时消息会被再次发布, 消费者需按 MessageId 去重
+type OutboxRelay struct {
+	Dns          string                             // 连接地址
+	DB           func(ctx context.Context) *gorm.DB // 数据库, 默认为 db.Dbc
+	BatchSize    int                                // 每批认领的数量, 默认100
+	Interval     time.Duration                      // 没有待发布消息时的轮询间隔, 默认1秒
+	Lease        time.Duration                      // 认领租约时长, 默认1分钟
+	MaxAttempts  int                                // 最大尝试次数, 超过后标记为 OutboxFailed, 默认10
+	Backoff      func(attempts int) time.Duration   // 第 attempts 次失败后的重试间隔, 默认指数退避 1秒~5分钟
+	Retention    time.Duration                      // 已发布消息保留时长, 默认7天, 小于0时不清理
+	CleanupEvery time.Duration                      // 清理间隔, 默认1小时
+
+	wake chan struct{}
+}
+
+// NewOutboxRelay 创建发件箱中继, 可在调用 Run 之前修改配置, 小于等于0的配置使用默认值
+func NewOutboxRelay(dns string) *OutboxRelay {
+	return &OutboxRelay{
+		Dns:          dns,
+		DB:           db.Dbc,
+		BatchSize:    100,
+		Interval:     time.Second,
+		Lease:        time.Minute,
+		MaxAttempts:  10,
+		Retention:    7 * 24 * time.Hour,
+		CleanupEvery: time.Hour,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Notify 唤醒中继立即发布, 可在事务提交后调用以降低延迟
+func (r *OutboxRelay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run 运行中继直到ctx结束, 持续有待发布的消息时清理同样按 CleanupEvery 执行
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	cleanup := time.NewTicker(r.cleanupEvery())
+	defer cleanup.Stop()
+	for {
+		select {
+		case <-cleanup.C:
+			r.cleanup(ctx)
+		default:
+		}
+		n, err := r.RelayOnce(ctx)
+		if err != nil {
+			log.Printf("[outbox] 发布失败 :%s \n", err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// 一批已满, 说明还有待发布的消息
+		if err == nil && n >= r.batchSize() {
+			continue
+		}
+		t := time.NewTimer(r.interval())
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-r.wake:
+		case <-t.C:
+		case <-cleanup.C:
+			r.cleanup(ctx)
+		}
+		t.Stop()
+	}
+}
+
+// cleanup 定时清理, 失败时只记录日志
+func (r *OutboxRelay) cleanup(ctx context.Context) {
+	if _, err := r.Cleanup(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("[outbox] 清理失败 :%s \n", err)
+	}
+}
+
+// dbc 数据库, 未设置时为 db.Dbc
+func (r *OutboxRelay) dbc(ctx context.Context) *gorm.DB {
+	if r.DB != nil {
+		return r.DB(ctx)
+	}
+	return db.Dbc(ctx)
+}
+
+// batchSize 每批认领的数量
+func (r *OutboxRelay) batchSize() int {
+	if r.BatchSize > 0 {
+		return r.BatchSize
+	}
+	return 100
+}
+
+// interval 空闲时的轮询间隔
+func (r *OutboxRelay) interval() time.Duration {
+	if r.Interval > 0 {
+		return r.Interval
+	}
+	return time.Second
+}
+
+// lease 认领租约时长
+func (r *OutboxRelay) lease() time.Duration {
+	if r.Lease > 0 {
+		return r.Lease
+	}
+	return time.Minute
+}
+
+// maxAttempts 最大尝试次数
+func (r *OutboxRelay) maxAttempts() int {
+	if r.MaxAttempts > 0 {
+		return r.MaxAttempts
+	}
+	return 10
+}
+
+// retention 已发布消息保留时长, 小于0时不清理
+func (r *OutboxRelay) retention() time.Duration {
+	if r.Retention != 0 {
+		return r.Retention
+	}
+	return 7 * 24 * time.Hour
+}
+
+// cleanupEvery 清理间隔
+func (r *OutboxRelay) cleanupEvery() time.Duration {
+	if r.CleanupEvery > 0 {
+		return r.CleanupEvery
+	}
+	return time.Hour
+}
+
+// RelayOnce 认领并发布一批消息, 返回认领的数量
+// 先查询候选消息再按条件更新租约, 多个实例同时认领时每条消息只会被其中一个认领成功
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	token := NewMessageID()
+	now := time.Now()
+	var ids []uint64
+	err := r.dbc(ctx).Model(&OutboxMessage{}).
+		Where("status = ? AND next_attempt_at <= ? AND (locked_until IS NULL OR locked_until < ?)", OutboxPending, now, now).
+		Order("id").Limit(r.batchSize()).Pluck("id", &ids).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res := r.dbc(ctx).Model(&OutboxMessage{}).
+		Where("id IN ? AND status = ? AND (locked_until IS NULL OR locked_until < ?)", ids, OutboxPending, now).
+		Updates(map[string]interface{}{"locked_by": token, "locked_until": now.Add(r.lease())})
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return 0, nil
+	}
+	list := make([]OutboxMessage, 0, res.RowsAffected)
+	if err := r.dbc(ctx).Where("locked_by = ?", token).Order("id").Find(&list).Error; err != nil {
+		return 0, err
+	}
+	// 未处理完的消息释放租约, 由下一轮继续发布
+	defer func() {
+		r.dbc(detach(ctx)).Model(&OutboxMessage{}).Where("locked_by = ?", token).
+			Updates(map[string]interface{}{"locked_by": nil, "locked_until": nil})
+	}()
+	for i := range list {
+		if ctx.Err() != nil {
+			return len(list), ctx.Err()
+		}
+		r.relay(ctx, token, &list[i])
+	}
+	return len(list), nil
+}
+
+// relay 发布单条消息并更新状态
+func (r *OutboxRelay) relay(ctx context.Context, token string, m *OutboxMessage) {
+	err := r.publish(ctx, m)
+	now := time.Now()
+	updates := map[string]interface{}{
+		"attempts":     m.Attempts + 1,
+		"locked_by":    nil,
+		"locked_until": nil,
+	}
+	if err == nil {
+		updates["status"] = OutboxSent
+		updates["sent_at"] = now
+		updates["last_error"] = ""
+	} else {
+		msg := err.Error()
+		if len(msg) > 1024 {
+			msg = msg[:1024]
+		}
+		updates["last_error"] = msg
+		updates["next_attempt_at"] = now.Add(r.backoff(m.Attempts + 1))
+		if m.Attempts+1 >= r.maxAttempts() {
+			updates["status"] = OutboxFailed
+			log.Printf("[outbox] 消息 %s 发布%d次仍失败, 已标记为失败 :%s \n", m.MessageId, m.Attempts+1, err)
+		}
+	}
+	// 发布结果需要落库, 不受ctx取消影响
+	if dbErr := r.dbc(detach(ctx)).Model(&OutboxMessage{}).
+		Where("id = ? AND locked_by = ?", m.ID, token).Updates(updates).Error; dbErr != nil {
+		log.Printf("[outbox] 更新消息 %s 状态失败 :%s \n", m.MessageId, dbErr)
+	}
+}
+
+// publish 以confirm模式发布, 链路延续写入发件箱时的span
+func (r *OutboxRelay) publish(ctx context.Context, m *OutboxMessage) (err error) {
+	t, err := m.topology()
+	if err != nil {
+		return err
+	}
+	msg, err := m.publishing()
+	if err != nil {
+		return err
+	}
+	span, ctx := startFollowSpan(ctx, "rabbitmq.outbox.relay", msg.Headers)
+	defer func() {
+		finishSpan(span, err)
+	}()
+	ctx, cancel := context.WithTimeout(ctx, PublishTimeout)
+	defer cancel()
+	return getPublisher(r.Dns).publish(ctx, t, msg)
+}
+
+// backoff 失败后的重试间隔
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	if r.Backoff != nil {
+		return r.Backoff(attempts)
+	}
+	d := time.Second
+	for i := 1; i < attempts && d < 5*time.Minute; i++ {
+		d *= 2
+	}
+	if d > 5*time.Minute {
+		d = 5 * time.Minute
+	}
+	return d
+}
+
+// Cleanup 删除超过保留时长的已发布消息, 每次最多删除1000条, 返回删除的数量
+func (r *OutboxRelay) Cleanup(ctx context.Context) (int64, error) {
+	retention := r.retention()
+	if retention < 0 {
+		return 0, nil
+	}
+	before := time.Now().Add(-retention)
+	var total int64
+	for {
+		var ids []uint64
+		err := r.dbc(ctx).Model(&OutboxMessage{}).Where("status = ? AND sent_at < ?", OutboxSent, before).
+			Order("id").Limit(1000).Pluck("id", &ids).Error
+		if err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		res := r.dbc(ctx).Where("id IN ? AND status = ?", ids, OutboxSent).Delete(&OutboxMessage{})
+		if res.Error != nil {
+			return total, res.Error
+		}
+		total += res.RowsAffected
+		if len(ids) < 1000 || ctx.Err() != nil {
+			return total, ctx.Err()
+		}
+	}
+}
+
+// RetryFailed 将失败的消息重置为待发布, ids 为空时重置全部, 返回重置的数量
+func (r *OutboxRelay) RetryFailed(ctx context.Context, ids ...uint64) (int64, error) {
+	tx := r.dbc(ctx).Model(&OutboxMessage{}).Where("status = ?", OutboxFailed)
+	if len(ids) > 0 {
+		tx = tx.Where("id IN ?", ids)
+	}
+	res := tx.Updates(map[string]interface{}{
+		"status":          OutboxPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	return res.RowsAffected, res.Error
+}
+
+// ErrOutboxNotFound 发件箱中没有对应的消息
+var ErrOutboxNotFound = errors.New("rabbitmq: outbox message not found")
+
+// Find 按消息ID查询发件箱记录
+func (r *OutboxRelay) Find(ctx context.Context, messageId string) (*OutboxMessage, error) {
+	m := &OutboxMessage{}
+	err := r.dbc(ctx).Where("message_id = ?", messageId).Take(m).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrOutboxNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
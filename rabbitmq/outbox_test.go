@@ -0,0 +1,262 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestOutbox 每个测试独立的sqlite发件箱与内存broker
+func newTestOutbox(t *testing.T) (*gorm.DB, *OutboxRelay, *MemoryBroker) {
+	t.Helper()
+	gdb, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "outbox.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	if err := MigrateOutbox(gdb); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestBroker(t)
+	r := NewOutboxRelay(b.DNS())
+	r.DB = func(ctx context.Context) *gorm.DB { return gdb.WithContext(ctx) }
+	return gdb, r, b
+}
+
+// saveTestOutbox 写入一条待发布消息
+func saveTestOutbox(t *testing.T, gdb *gorm.DB, qe QueueExchange, body string) *OutboxMessage {
+	t.Helper()
+	m, err := SaveOutbox(gdb, qe, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// loadOutbox 读取发件箱记录
+func loadOutbox(t *testing.T, gdb *gorm.DB, id uint64) OutboxMessage {
+	t.Helper()
+	var m OutboxMessage
+	if err := gdb.Take(&m, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestOutboxRelayClaim(t *testing.T) {
+	gdb, r, b := newTestOutbox(t)
+	qe := QueueExchange{QuName: "outbox", Dns: b.DNS()}
+	ctx := context.Background()
+
+	ready := saveTestOutbox(t, gdb, qe, "ready")
+	expired := saveTestOutbox(t, gdb, qe, "expired lease")
+	leased := saveTestOutbox(t, gdb, qe, "leased")
+	later := saveTestOutbox(t, gdb, qe, "later")
+	owner, past, future := "other", time.Now().Add(-time.Second), time.Now().Add(time.Minute)
+	gdb.Model(&OutboxMessage{}).Where("id = ?", expired.ID).Updates(map[string]interface{}{"locked_by": owner, "locked_until": past})
+	gdb.Model(&OutboxMessage{}).Where("id = ?", leased.ID).Updates(map[string]interface{}{"locked_by": owner, "locked_until": future})
+	gdb.Model(&OutboxMessage{}).Where("id = ?", later.ID).Update("next_attempt_at", future)
+
+	n, err := r.RelayOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("claimed %d, want 2", n)
+	}
+	for _, m := range []*OutboxMessage{ready, expired} {
+		got := loadOutbox(t, gdb, m.ID)
+		if got.Status != OutboxSent || got.SentAt == nil || got.Attempts != 1 || got.LockedBy != nil {
+			t.Fatalf("%s: status %d attempts %d locked %v, want sent and unlocked", m.Body, got.Status, got.Attempts, got.LockedBy)
+		}
+	}
+	for _, m := range []*OutboxMessage{leased, later} {
+		if got := loadOutbox(t, gdb, m.ID); got.Status != OutboxPending || got.Attempts != 0 {
+			t.Fatalf("%s: status %d attempts %d, want untouched", m.Body, got.Status, got.Attempts)
+		}
+	}
+	if got := loadOutbox(t, gdb, leased.ID); got.LockedBy == nil || *got.LockedBy != owner {
+		t.Fatal("lease of another relay was taken over before it expired")
+	}
+	if ready, _ := b.QueueDepth("outbox"); ready != 2 {
+		t.Fatalf("queue depth = %d, want 2", ready)
+	}
+}
+
+func TestOutboxRelayReleasesLease(t *testing.T) {
+	gdb, r, b := newTestOutbox(t)
+	qe := QueueExchange{QuName: "outbox", Dns: b.DNS()}
+	// 认领后ctx已结束, 未发布的消息应释放租约
+	r.DB = func(context.Context) *gorm.DB { return gdb }
+	for _, body := range []string{"1", "2", "3"} {
+		saveTestOutbox(t, gdb, qe, body)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	n, err := r.RelayOnce(ctx)
+	if !errors.Is(err, context.Canceled) || n != 3 {
+		t.Fatalf("RelayOnce = %d, %v, want 3, context.Canceled", n, err)
+	}
+	var list []OutboxMessage
+	gdb.Order("id").Find(&list)
+	for _, m := range list {
+		if m.Status != OutboxPending || m.LockedBy != nil || m.LockedUntil != nil || m.Attempts != 0 {
+			t.Fatalf("%s: status %d locked %v attempts %d, want pending and released", m.Body, m.Status, m.LockedBy, m.Attempts)
+		}
+	}
+
+	n, err = r.RelayOnce(context.Background())
+	if err != nil || n != 3 {
+		t.Fatalf("RelayOnce after release = %d, %v, want 3", n, err)
+	}
+}
+
+func TestOutboxRelayBackoff(t *testing.T) {
+	gdb, r, b := newTestOutbox(t)
+	// 队列不存在且不声明, 发布时不可路由
+	qe := QueueExchange{QuName: "missing", SkipDeclare: true, Dns: b.DNS()}
+	r.MaxAttempts = 2
+	r.Backoff = func(attempts int) time.Duration { return time.Duration(attempts) * time.Hour }
+	m := saveTestOutbox(t, gdb, qe, "unroutable")
+
+	start := time.Now()
+	if _, err := r.RelayOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := loadOutbox(t, gdb, m.ID)
+	if got.Status != OutboxPending || got.Attempts != 1 || got.LastError == "" || got.LockedBy != nil {
+		t.Fatalf("after first failure: status %d attempts %d error %q", got.Status, got.Attempts, got.LastError)
+	}
+	if d := got.NextAttemptAt.Sub(start); d < time.Hour || d > time.Hour+time.Minute {
+		t.Fatalf("next attempt in %v, want 1h", d)
+	}
+	if n, _ := r.RelayOnce(context.Background()); n != 0 {
+		t.Fatalf("claimed %d before the backoff elapsed", n)
+	}
+
+	gdb.Model(&OutboxMessage{}).Where("id = ?", m.ID).Update("next_attempt_at", time.Now().Add(-time.Second))
+	if _, err := r.RelayOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadOutbox(t, gdb, m.ID); got.Status != OutboxFailed || got.Attempts != 2 {
+		t.Fatalf("after max attempts: status %d attempts %d, want failed", got.Status, got.Attempts)
+	}
+
+	if n, err := r.RetryFailed(context.Background()); err != nil || n != 1 {
+		t.Fatalf("RetryFailed = %d, %v, want 1", n, err)
+	}
+	if got := loadOutbox(t, gdb, m.ID); got.Status != OutboxPending || got.Attempts != 0 {
+		t.Fatalf("after RetryFailed: status %d attempts %d, want pending", got.Status, got.Attempts)
+	}
+}
+
+func TestOutboxRelayCleanup(t *testing.T) {
+	gdb, r, b := newTestOutbox(t)
+	qe := QueueExchange{QuName: "outbox", Dns: b.DNS()}
+	old := saveTestOutbox(t, gdb, qe, "old")
+	recent := saveTestOutbox(t, gdb, qe, "recent")
+	failed := saveTestOutbox(t, gdb, qe, "failed")
+	gdb.Model(&OutboxMessage{}).Where("id = ?", old.ID).Updates(map[string]interface{}{"status": OutboxSent, "sent_at": time.Now().Add(-48 * time.Hour)})
+	gdb.Model(&OutboxMessage{}).Where("id = ?", recent.ID).Updates(map[string]interface{}{"status": OutboxSent, "sent_at": time.Now()})
+	gdb.Model(&OutboxMessage{}).Where("id = ?", failed.ID).Update("status", OutboxFailed)
+
+	r.Retention = -1
+	if n, err := r.Cleanup(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Cleanup with negative retention = %d, %v, want 0", n, err)
+	}
+	r.Retention = 24 * time.Hour
+	if n, err := r.Cleanup(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Cleanup = %d, %v, want 1", n, err)
+	}
+	var ids []uint64
+	gdb.Model(&OutboxMessage{}).Order("id").Pluck("id", &ids)
+	if len(ids) != 2 || ids[0] != recent.ID || ids[1] != failed.ID {
+		t.Fatalf("remaining ids = %v, want [%d %d]", ids, recent.ID, failed.ID)
+	}
+}
+
+func TestOutboxRelayRun(t *testing.T) {
+	gdb, r, b := newTestOutbox(t)
+	qe := QueueExchange{QuName: "outbox", Dns: b.DNS()}
+	var queries int64
+	r.DB = func(ctx context.Context) *gorm.DB {
+		atomic.AddInt64(&queries, 1)
+		return gdb.WithContext(ctx)
+	}
+	// 零值配置使用默认值, 不会因批量为0而空转
+	r.BatchSize = 0
+	r.Interval = 0
+	r.Retention = time.Hour
+	r.CleanupEvery = 20 * time.Millisecond
+	old := saveTestOutbox(t, gdb, qe, "old")
+	gdb.Model(&OutboxMessage{}).Where("id = ?", old.ID).Updates(map[string]interface{}{"status": OutboxSent, "sent_at": time.Now().Add(-2 * time.Hour)})
+	for _, body := range []string{"1", "2"} {
+		saveTestOutbox(t, gdb, qe, body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := r.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run = %v, want context.DeadlineExceeded", err)
+	}
+	if ready, _ := b.QueueDepth("outbox"); ready != 2 {
+		t.Fatalf("queue depth = %d, want 2", ready)
+	}
+	var count int64
+	gdb.Model(&OutboxMessage{}).Where("id = ?", old.ID).Count(&count)
+	if count != 0 {
+		t.Fatal("sent message past retention was not cleaned up")
+	}
+	if n := atomic.LoadInt64(&queries); n > 50 {
+		t.Fatalf("%d queries in 300ms, relay is busy looping", n)
+	}
+}
+
+func TestOutboxRelayCleanupWhileBusy(t *testing.T) {
+	gdb, r, b := newTestOutbox(t)
+	qe := QueueExchange{QuName: "outbox", Dns: b.DNS()}
+	r.BatchSize = 1
+	r.Retention = time.Hour
+	r.CleanupEvery = time.Millisecond
+	old := saveTestOutbox(t, gdb, qe, "old")
+	gdb.Model(&OutboxMessage{}).Where("id = ?", old.ID).Updates(map[string]interface{}{"status": OutboxSent, "sent_at": time.Now().Add(-2 * time.Hour)})
+	for i := 0; i < 200; i++ {
+		saveTestOutbox(t, gdb, qe, "busy")
+	}
+
+	// 每批都已满时同样执行清理
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = r.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	var pending int64
+	waitFor(t, "cleanup while busy", func() bool {
+		var count int64
+		gdb.Model(&OutboxMessage{}).Where("id = ?", old.ID).Count(&count)
+		gdb.Model(&OutboxMessage{}).Where("status = ?", OutboxPending).Count(&pending)
+		return count == 0
+	})
+	if pending == 0 {
+		t.Fatal("cleanup only ran after all messages were relayed")
+	}
+}
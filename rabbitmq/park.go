@@ -0,0 +1,295 @@
+package rabbitmq
+
+import (
+	"context"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// 停放消息相关的header
+const (
+	headerRetryHistory     = "x-retry-history"
+	headerParkedError      = "x-parked-error"
+	headerParkedAt         = "x-parked-at"
+	headerOriginalQueue    = "x-original-queue"
+	headerOriginalExchange = "x-original-exchange"
+	headerOriginalKey      = "x-original-routing-key"
+)
+
+// ParkingQueueName 队列对应的停放(死信)队列名称
+func ParkingQueueName(queueExchange QueueExchange) string {
+	return queueExchange.QuName + "_parked"
+}
+
+// parkTopology 停放队列, 不绑定交换机, 通过默认交换机直接投递
+func parkTopology(queueExchange QueueExchange) topology {
+	return topology{queue: ParkingQueueName(queueExchange)}
+}
+
+// parkMsg 重试次数用尽后将消息投递到停放队列
+// 保留原始body、headers与属性, 并记录错误信息、原始交换机/路由key与重试历史
+// ctx 仅用于传递链路信息
+func parkMsg(ctx context.Context, msg amqp.Delivery, retryNums int32, cause error, queueExchange QueueExchange) error {
+	headers := make(amqp.Table, len(msg.Headers)+5)
+	for k, v := range msg.Headers {
+		if k == "x-death" {
+			continue
+		}
+		headers[k] = v
+	}
+	exchange, key := queueTopology(queueExchange).target()
+	headers[headerParkedError] = cause.Error()
+	headers[headerParkedAt] = time.Now()
+	headers[headerOriginalQueue] = queueExchange.QuName
+	headers[headerOriginalExchange] = exchange
+	headers[headerOriginalKey] = key
+	headers["retry_nums"] = retryNums
+
+	ctx, cancel := context.WithTimeout(detach(ctx), PublishTimeout)
+	defer cancel()
+	return getPublisher(queueExchange.Dns).publish(ctx, parkTopology(queueExchange), amqp.Publishing{
+		ContentType:   msg.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		Priority:      msg.Priority,
+		CorrelationId: msg.CorrelationId,
+		MessageId:     msg.MessageId,
+		AppId:         msg.AppId,
+		Type:          msg.Type,
+		Timestamp:     msg.Timestamp,
+		Body:          msg.Body,
+		Headers:       headers,
+	})
+}
+
+// RetryRecord 一次失败重试的记录
+type RetryRecord struct {
+	Attempt int       // 第几次重试
+	Error   string    // 失败原因
+	At      time.Time // 失败时间
+}
+
+// ParkedMessage 停放队列中的消息
+type ParkedMessage struct {
+	Body        []byte
+	ContentType string
+	MessageId   string
+	Headers     amqp.Table    // 原始headers(含停放信息)
+	Queue       string        // 原始队列
+	Exchange    string        // 原始交换机
+	RoutingKey  string        // 原始路由key
+	Error       string        // 最后一次失败原因
+	ParkedAt    time.Time     // 停放时间
+	History     []RetryRecord // 重试历史
+}
+
+// newParkedMessage 从投递的消息中解析停放信息
+func newParkedMessage(d amqp.Delivery) ParkedMessage {
+	m := ParkedMessage{
+		Body:        d.Body,
+		ContentType: d.ContentType,
+		MessageId:   d.MessageId,
+		Headers:     d.Headers,
+	}
+	m.Queue, _ = d.Headers[headerOriginalQueue].(string)
+	m.Exchange, _ = d.Headers[headerOriginalExchange].(string)
+	m.RoutingKey, _ = d.Headers[headerOriginalKey].(string)
+	m.Error, _ = d.Headers[headerParkedError].(string)
+	m.ParkedAt, _ = d.Headers[headerParkedAt].(time.Time)
+	history, _ := d.Headers[headerRetryHistory].([]interface{})
+	for _, h := range history {
+		t, ok := h.(amqp.Table)
+		if !ok {
+			continue
+		}
+		r := RetryRecord{}
+		r.Attempt = int(toInt64(t["attempt"]))
+		r.Error, _ = t["error"].(string)
+		r.At, _ = t["at"].(time.Time)
+		m.History = append(m.History, r)
+	}
+	return m
+}
+
+// toInt64 amqp.Table 中整数可能以不同类型返回
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case uint8:
+		return int64(n)
+	case uint16:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	}
+	return 0
+}
+
+// Parking 停放队列管理, 支持查看、重放与清空
+type Parking struct {
+	queueExchange QueueExchange
+}
+
+// NewParking 创建队列对应的停放队列管理对象
+func NewParking(queueExchange QueueExchange) *Parking {
+	return &Parking{queueExchange: queueExchange}
+}
+
+// channel 打开管道并确保停放队列存在
+func (p *Parking) channel(ctx context.Context) (channel, error) {
+	conn := getPublisher(p.queueExchange.Dns).conn
+	if err := conn.WaitReady(ctx); err != nil {
+		return nil, err
+	}
+	ch, err := conn.channel()
+	if err != nil {
+		return nil, err
+	}
+	if err = parkTopology(p.queueExchange).declare(ch); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Count 停放队列中的消息数量
+func (p *Parking) Count(ctx context.Context) (int, error) {
+	ch, err := p.channel(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	q, err := ch.QueueInspect(ParkingQueueName(p.queueExchange))
+	if err != nil {
+		return 0, err
+	}
+	return q.Messages, nil
+}
+
+// Inspect 查看最多 limit 条停放消息, 不会移除消息
+func (p *Parking) Inspect(ctx context.Context, limit int) ([]ParkedMessage, error) {
+	ch, err := p.channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// 关闭管道后未ack的消息会回到队列
+	defer func() {
+		_ = ch.Close()
+	}()
+
+	list := make([]ParkedMessage, 0)
+	for len(list) < limit {
+		if ctx.Err() != nil {
+			return list, ctx.Err()
+		}
+		d, ok, err := ch.Get(ParkingQueueName(p.queueExchange), false)
+		if err != nil {
+			return list, err
+		}
+		if !ok {
+			break
+		}
+		list = append(list, newParkedMessage(d))
+	}
+	return list, nil
+}
+
+// Replay 将最多 limit 条停放消息重新发布到原始交换机/路由key, 重试次数清零
+// 返回成功重放的数量, 发布失败的消息保留在停放队列中
+func (p *Parking) Replay(ctx context.Context, limit int) (int, error) {
+	ch, err := p.channel(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+
+	publisher := getPublisher(p.queueExchange.Dns)
+	replayed := 0
+	for replayed < limit {
+		if ctx.Err() != nil {
+			return replayed, ctx.Err()
+		}
+		d, ok, err := ch.Get(ParkingQueueName(p.queueExchange), false)
+		if err != nil {
+			return replayed, err
+		}
+		if !ok {
+			break
+		}
+		if err = publisher.publish(ctx, p.replayTopology(d), replayPublishing(d)); err != nil {
+			_ = d.Nack(false, true)
+			return replayed, err
+		}
+		if err = d.Ack(false); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// replayTopology 重放的目标, 优先使用消息中记录的原始交换机/路由key
+func (p *Parking) replayTopology(d amqp.Delivery) topology {
+	t := queueTopology(p.queueExchange)
+	m := newParkedMessage(d)
+	if m.Exchange != "" || m.RoutingKey != "" {
+		t.exchange = m.Exchange
+		if m.Exchange != "" {
+			t.routingKey = m.RoutingKey
+		} else {
+			t.routingKey = ""
+			t.queue = m.RoutingKey
+		}
+	}
+	return t
+}
+
+// replayPublishing 去掉停放信息, 保留原始属性与重试历史
+func replayPublishing(d amqp.Delivery) amqp.Publishing {
+	headers := make(amqp.Table, len(d.Headers))
+	for k, v := range d.Headers {
+		switch k {
+		case headerParkedError, headerParkedAt, headerOriginalQueue, headerOriginalExchange, headerOriginalKey, "x-death":
+			continue
+		}
+		headers[k] = v
+	}
+	headers["retry_nums"] = int32(0)
+	return amqp.Publishing{
+		ContentType:   d.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		Priority:      d.Priority,
+		CorrelationId: d.CorrelationId,
+		MessageId:     d.MessageId,
+		AppId:         d.AppId,
+		Type:          d.Type,
+		Timestamp:     d.Timestamp,
+		Body:          d.Body,
+		Headers:       headers,
+	}
+}
+
+// Purge 清空停放队列, 返回清除的消息数量
+func (p *Parking) Purge(ctx context.Context) (int, error) {
+	ch, err := p.channel(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	return ch.QueuePurge(ParkingQueueName(p.queueExchange), false)
+}
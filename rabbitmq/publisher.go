@@ -0,0 +1,311 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PublisherPoolSize Send 使用的共享生产者管道池大小
+var PublisherPoolSize = 8
+
+// Publisher 长连接生产者, 复用一个连接与一组confirm管道, 并发安全
+type Publisher struct {
+	conn *Connection
+	size int
+
+	mu       sync.Mutex
+	opened   int
+	idle     chan *confirmChannel
+	declared map[string]time.Time // 已声明的拓扑与声明时间
+	spool    *Spool
+
+	delayMu     sync.Mutex
+	delayProbed bool        // 已探测 x-delayed-message 插件
+	delayPlugin bool        // 插件可用
+	delayProbe  *delayProbe // 正在进行的探测
+}
+
+// NewPublisher 创建生产者, size 为管道池大小
+// 首次连接失败时返回错误, 但生产者仍可使用, 连接会在后台自动重连
+func NewPublisher(dns string, size int) (*Publisher, error) {
+	if size <= 0 {
+		size = 1
+	}
+	p := &Publisher{
+		conn:     NewConnection(dns),
+		size:     size,
+		idle:     make(chan *confirmChannel, size),
+		declared: make(map[string]time.Time),
+	}
+	events := p.conn.NotifyState(make(chan StateEvent, 8))
+	go func() {
+		for {
+			select {
+			case e := <-events:
+				// 重连后broker上的拓扑可能已经丢失, 需要重新声明
+				if e.State == StateDisconnected {
+					p.resetDeclared()
+				}
+			case <-p.conn.done:
+				return
+			}
+		}
+	}()
+	err := p.conn.Connect()
+	return p, err
+}
+
+// Connection 获取生产者使用的自愈连接
+func (p *Publisher) Connection() *Connection {
+	return p.conn
+}
+
+// Publish 发布消息, broker确认后返回, 会自动声明 QueueExchange 对应的交换机与队列
+// 消息默认持久化, 可通过 opts 设置优先级、过期时间、headers等属性
+func (p *Publisher) Publish(ctx context.Context, queueExchange QueueExchange, msg string, opts ...PublishOption) error {
+	return p.deliver(ctx, queueTopology(queueExchange), newPublishing(ContentTypeText, []byte(msg), opts...))
+}
+
+// deliver 发布消息, 开启本地缓存时连接不可用或缓存中还有待发布的消息则写入缓存
+func (p *Publisher) deliver(ctx context.Context, t topology, msg amqp.Publishing) error {
+	s := p.getSpool()
+	if s == nil {
+		return p.publish(ctx, t, msg)
+	}
+	if s.Pending() == 0 && p.conn.State() == StateConnected {
+		err := p.publish(ctx, t, msg)
+		if err == nil || !spoolable(err) {
+			return err
+		}
+		log.Printf("[spool] 发布失败, 写入本地缓存 :%s \n", err)
+	}
+	return s.append(ctx, t, msg, false)
+}
+
+// getSpool 已开启的本地缓存
+func (p *Publisher) getSpool() *Spool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.spool
+}
+
+// publish 声明拓扑(已声明过的跳过)并以confirm模式发布, ctx中的span会注入消息headers
+func (p *Publisher) publish(ctx context.Context, t topology, msg amqp.Publishing) error {
+	exchange, key := t.target()
+	return p.send(ctx, &t, exchange, key, msg)
+}
+
+// publishTo 不声明任何拓扑, 直接发布到指定交换机与路由key, 如RPC的回复队列
+func (p *Publisher) publishTo(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	return p.send(ctx, nil, exchange, key, msg)
+}
+
+// send 从池中取出管道, 按需声明拓扑后发布并等待确认
+func (p *Publisher) send(ctx context.Context, t *topology, exchange, key string, msg amqp.Publishing) (err error) {
+	span := startPublishSpan(ctx, exchange, key, &msg)
+	start := time.Now()
+	defer func() {
+		metrics().ObservePublish(exchange, time.Since(start), err)
+		finishSpan(span, err)
+	}()
+	cc, err := p.get(ctx)
+	if err != nil {
+		return &PublishError{Kind: err, Exchange: exchange, RoutingKey: key}
+	}
+
+	if t != nil && !p.isDeclared(*t) {
+		if err = t.declare(cc.ch); err != nil {
+			// 声明失败broker会关闭管道
+			p.discard(cc)
+			return &PublishError{Kind: err, Exchange: exchange, RoutingKey: key}
+		}
+		p.setDeclared(*t)
+	}
+
+	err = cc.publish(ctx, exchange, key, msg)
+	if (err != nil && !cc.alive()) || errors.Is(err, ErrPublishTimeout) {
+		p.discard(cc)
+	} else {
+		p.put(cc)
+	}
+	return err
+}
+
+// ensure 声明拓扑(已声明过的跳过), 不发布消息, 如延迟消息的目标队列
+func (p *Publisher) ensure(ctx context.Context, t topology) error {
+	if p.isDeclared(t) {
+		return nil
+	}
+	cc, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	if err = t.declare(cc.ch); err != nil {
+		p.discard(cc)
+		return err
+	}
+	p.setDeclared(t)
+	p.put(cc)
+	return nil
+}
+
+// get 从池中获取管道, 池中没有空闲管道且未达到上限时新建
+func (p *Publisher) get(ctx context.Context) (*confirmChannel, error) {
+	for {
+		select {
+		case cc := <-p.idle:
+			if cc.alive() {
+				return cc, nil
+			}
+			p.discard(cc)
+			continue
+		default:
+		}
+
+		p.mu.Lock()
+		if p.opened < p.size {
+			p.opened++
+			p.mu.Unlock()
+			cc, err := p.open(ctx)
+			if err != nil {
+				p.mu.Lock()
+				p.opened--
+				p.mu.Unlock()
+				return nil, err
+			}
+			return cc, nil
+		}
+		p.mu.Unlock()
+
+		select {
+		case cc := <-p.idle:
+			if cc.alive() {
+				return cc, nil
+			}
+			p.discard(cc)
+		case <-ctx.Done():
+			return nil, publishTimeout(ctx)
+		}
+	}
+}
+
+// open 等待连接可用并打开一个confirm管道, 等待期间ctx结束返回 ErrPublishTimeout
+func (p *Publisher) open(ctx context.Context) (*confirmChannel, error) {
+	if err := p.conn.WaitReady(ctx); err != nil {
+		if err == ErrConnectionClosed {
+			return nil, err
+		}
+		return nil, publishTimeout(ctx)
+	}
+	ch, err := p.conn.channel()
+	if err != nil {
+		return nil, err
+	}
+	cc, err := newConfirmChannel(ch)
+	if err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// put 归还管道
+func (p *Publisher) put(cc *confirmChannel) {
+	select {
+	case p.idle <- cc:
+	default:
+		p.discard(cc)
+	}
+}
+
+// discard 关闭并丢弃管道
+func (p *Publisher) discard(cc *confirmChannel) {
+	_ = cc.ch.Close()
+	p.mu.Lock()
+	p.opened--
+	p.mu.Unlock()
+}
+
+// isDeclared 拓扑已声明且未超过重新声明的间隔
+func (p *Publisher) isDeclared(t topology) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at, ok := p.declared[t.key()]
+	return ok && (t.redeclare <= 0 || time.Since(at) < t.redeclare)
+}
+
+func (p *Publisher) setDeclared(t topology) {
+	p.mu.Lock()
+	p.declared[t.key()] = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *Publisher) resetDeclared() {
+	p.mu.Lock()
+	p.declared = make(map[string]time.Time)
+	p.mu.Unlock()
+}
+
+// Close 关闭本地缓存、所有管道与连接
+func (p *Publisher) Close() error {
+	if s := p.getSpool(); s != nil {
+		if err := s.Close(); err != nil {
+			log.Printf("[spool] 关闭失败 :%s \n", err)
+		}
+	}
+	for {
+		select {
+		case cc := <-p.idle:
+			p.discard(cc)
+		default:
+			return p.conn.Close()
+		}
+	}
+}
+
+// 按连接地址共享的生产者, 供 Send 与重试使用
+var (
+	publisherMu sync.Mutex
+	publishers  = make(map[string]*Publisher)
+)
+
+// getPublisher 获取连接地址对应的共享生产者
+func getPublisher(dns string) *Publisher {
+	publisherMu.Lock()
+	defer publisherMu.Unlock()
+	if p, ok := publishers[dns]; ok {
+		return p
+	}
+	p, err := NewPublisher(dns, PublisherPoolSize)
+	if err != nil {
+		log.Printf("链接mq失败  :%s \n", err)
+	}
+	publishers[dns] = p
+	return p
+}
+
+// ClosePublishers 关闭 Send 使用的所有共享生产者, 一般在进程退出前调用
+func ClosePublishers() {
+	publisherMu.Lock()
+	defer publisherMu.Unlock()
+	for dns, p := range publishers {
+		_ = p.Close()
+		delete(publishers, dns)
+	}
+}
+
+// closePublisher 关闭并移除地址对应的共享生产者
+func closePublisher(dns string) {
+	publisherMu.Lock()
+	p, ok := publishers[dns]
+	delete(publishers, dns)
+	publisherMu.Unlock()
+	if ok {
+		_ = p.Close()
+	}
+}
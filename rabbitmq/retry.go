@@ -0,0 +1,163 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RetryPolicy 消费失败后的重试策略
+type RetryPolicy struct {
+	MaxAttempts int             // 最大重试次数, 超过后调用 Receiver.FailAction
+	Backoff     []time.Duration // 每次重试的延迟, 如 5s/30s/5m/1h, 重试次数超过档位数时使用最后一档
+	Jitter      float64         // 随机抖动比例 0~1, 实际延迟在 [d*(1-Jitter), d] 之间
+}
+
+// DefaultRetryPolicy 未配置重试策略时使用, 重试3次, 每次间隔20秒
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     []time.Duration{20 * time.Second},
+}
+
+// retryPolicy 获取生效的重试策略
+func (q QueueExchange) retryPolicy() RetryPolicy {
+	if q.Retry == nil {
+		return DefaultRetryPolicy
+	}
+	return *q.Retry
+}
+
+// delay 第 retryNums 次重试(从0开始)对应的档位延迟
+func (p RetryPolicy) delay(retryNums int32) time.Duration {
+	if len(p.Backoff) == 0 {
+		return DefaultRetryPolicy.Backoff[0]
+	}
+	i := int(retryNums)
+	if i >= len(p.Backoff) {
+		i = len(p.Backoff) - 1
+	}
+	if i < 0 {
+		i = 0
+	}
+	return p.Backoff[i]
+}
+
+// expiration 加入抖动后的单条消息过期时间, 只向下抖动, 保证不超过档位队列的TTL
+func (p RetryPolicy) expiration(d time.Duration) string {
+	if p.Jitter <= 0 {
+		return ""
+	}
+	jitter := p.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	ms := d.Milliseconds()
+	cut := int64(float64(ms) * jitter)
+	if cut > 0 {
+		ms -= rand.Int63n(cut + 1)
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// formatDelay 档位延迟的简写, 用于队列命名, 如 5s 30s 5m 1h 1500ms
+func formatDelay(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
+
+// delayTopology 延迟档位队列, 消息过期后经死信回到原队列
+// 档位队列命名为 <队列名>_retry_<延迟>, 如 order_retry_5m
+// 档位队列不绑定到业务交换机, 通过默认交换机直接投递, 过期后也经默认交换机只回到原队列,
+// 避免 fanout/headers 交换机把普通消息复制到档位队列, 或把重试消息投递给其他绑定的队列
+// 档位队列闲置 2d+delayQueueIdle 后由broker删除(x-expires); 发布消息不会重置闲置时间,
+// 因此发布时每隔 d 重新声明一次, 保证队列删除前其中的消息均已过期
+func delayTopology(queueExchange QueueExchange, suffix string, d time.Duration) topology {
+	return topology{
+		queue: fmt.Sprintf("%s_%s_%s", queueExchange.QuName, suffix, formatDelay(d)),
+		queueArgs: amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueExchange.QuName,
+			"x-message-ttl":             d.Milliseconds(),
+			"x-expires":                 (2*d + delayQueueIdle).Milliseconds(),
+		},
+		redeclare: d,
+	}
+}
+
+// delayQueueIdle 档位队列在最后的消息过期后保留的时长
+const delayQueueIdle = 10 * time.Minute
+
+// retryCount 消息已重试次数
+func retryCount(msg amqp.Delivery) int32 {
+	retryNums, ok := msg.Headers["retry_nums"].(int32)
+	if !ok {
+		return 0
+	}
+	return retryNums
+}
+
+// retryHeaders 复制原消息headers, counted 为true时更新重试次数并追加本次失败记录
+func retryHeaders(msg amqp.Delivery, retryNums int32, cause error, counted bool) amqp.Table {
+	headers := make(amqp.Table, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		// x-death 由broker维护, 重新发布时去掉避免无限增长
+		if k == "x-death" {
+			continue
+		}
+		headers[k] = v
+	}
+	if !counted {
+		return headers
+	}
+	history, _ := msg.Headers[headerRetryHistory].([]interface{})
+	history = append(append([]interface{}{}, history...), amqp.Table{
+		"attempt": retryNums + 1,
+		"error":   cause.Error(),
+		"at":      time.Now(),
+	})
+	headers[headerRetryHistory] = history
+	headers["retry_nums"] = retryNums + int32(1)
+	return headers
+}
+
+// retryMsg 消息处理失败之后 延时尝试
+// 投递到延迟 d 对应的延迟队列, 保留原消息属性与headers
+// counted 为false时不计入重试次数, 用于 Defer
+// ctx 仅用于传递链路信息
+func retryMsg(ctx context.Context, msg amqp.Delivery, retryNums int32, cause error, queueExchange QueueExchange, d time.Duration, counted bool) error {
+	policy := queueExchange.retryPolicy()
+
+	ctx, cancel := context.WithTimeout(detach(ctx), PublishTimeout)
+	defer cancel()
+	pub := republishing(msg, retryHeaders(msg, retryNums, cause, counted))
+	pub.Expiration = policy.expiration(d)
+	return getPublisher(queueExchange.Dns).publish(ctx, delayTopology(queueExchange, "retry", d), pub)
+}
+
+// republishing 重新发布时保留原消息的属性
+func republishing(msg amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType:   msg.ContentType,
+		DeliveryMode:  msg.DeliveryMode,
+		Priority:      msg.Priority,
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		MessageId:     msg.MessageId,
+		AppId:         msg.AppId,
+		Type:          msg.Type,
+		Timestamp:     msg.Timestamp,
+		Body:          msg.Body,
+		Headers:       headers,
+	}
+}
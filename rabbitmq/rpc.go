@@ -0,0 +1,323 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// headerRPCError 服务端处理失败时回复中携带的错误信息
+const headerRPCError = "x-rpc-error"
+
+var (
+	// ErrRPCConnectionLost 等待回复期间连接断开, 回复队列已失效
+	ErrRPCConnectionLost = errors.New("rabbitmq: rpc reply queue lost")
+	// ErrRPCClosed 客户端已关闭
+	ErrRPCClosed = errors.New("rabbitmq: rpc client closed")
+)
+
+// RPCError 服务端处理请求返回的错误
+type RPCError struct {
+	Message string
+}
+
+// Error error接口实现
+func (e *RPCError) Error() string {
+	return "rabbitmq: rpc remote error: " + e.Message
+}
+
+// rpcResult 一次调用的结果
+type rpcResult struct {
+	body []byte
+	err  error
+}
+
+// RPCClient 请求/回复客户端, 所有请求共享一个独占的回复队列, 通过 CorrelationId 匹配回复
+type RPCClient struct {
+	conn *Connection
+
+	mu         sync.Mutex
+	ch         channel
+	replyQueue string
+	ready      chan struct{} // 回复队列可用时关闭
+	pending    map[string]chan rpcResult
+}
+
+// NewRPCClient 创建RPC客户端
+// 首次连接失败时返回错误, 但客户端仍可使用, 连接恢复后会重新创建回复队列
+func NewRPCClient(dns string) (*RPCClient, error) {
+	c := &RPCClient{
+		conn:    NewConnection(dns),
+		ready:   make(chan struct{}),
+		pending: make(map[string]chan rpcResult),
+	}
+	err := c.conn.Connect()
+	go c.run()
+	return c, err
+}
+
+// run 维护回复队列, 连接断开后重建, 并让等待中的调用失败
+func (c *RPCClient) run() {
+	attempt := 0
+	for {
+		if err := c.conn.WaitReady(context.Background()); err != nil {
+			c.failAll(ErrRPCClosed)
+			return
+		}
+		started, err := c.listen()
+		c.failAll(ErrRPCConnectionLost)
+		if c.conn.IsClosed() {
+			c.failAll(ErrRPCClosed)
+			return
+		}
+		if started {
+			attempt = 0
+		}
+		attempt++
+		log.Printf("[rpc] 回复队列中断, 准备恢复(第%d次) :%v \n", attempt, err)
+		if !c.conn.sleep(backoff(attempt)) {
+			c.failAll(ErrRPCClosed)
+			return
+		}
+	}
+}
+
+// listen 声明回复队列并分发回复, 直到管道关闭
+func (c *RPCClient) listen() (started bool, err error) {
+	ch, err := c.conn.channel()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	// 服务端命名的独占队列, 连接断开后自动删除
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return false, err
+	}
+	deliveries, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return false, err
+	}
+	returns := ch.NotifyReturn(make(chan amqp.Return, 16))
+
+	c.mu.Lock()
+	c.ch = ch
+	c.replyQueue = q.Name
+	close(c.ready)
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.ch = nil
+		c.replyQueue = ""
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return true, amqp.ErrClosed
+			}
+			result := rpcResult{body: d.Body}
+			if msg, ok := d.Headers[headerRPCError].(string); ok {
+				result = rpcResult{err: &RPCError{Message: msg}}
+			}
+			c.resolve(d.CorrelationId, result)
+		case r, ok := <-returns:
+			if !ok {
+				return true, amqp.ErrClosed
+			}
+			// 请求无法路由到任何服务端队列
+			c.resolve(r.CorrelationId, rpcResult{err: &PublishError{
+				Kind: ErrUnroutable, Exchange: r.Exchange, RoutingKey: r.RoutingKey, ReplyCode: r.ReplyCode, ReplyText: r.ReplyText,
+			}})
+		}
+	}
+}
+
+// resolve 将结果交给等待中的调用
+func (c *RPCClient) resolve(correlationId string, result rpcResult) {
+	c.mu.Lock()
+	waiter, ok := c.pending[correlationId]
+	delete(c.pending, correlationId)
+	c.mu.Unlock()
+	if ok {
+		waiter <- result
+	}
+}
+
+// failAll 让所有等待中的调用失败
+func (c *RPCClient) failAll(err error) {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]chan rpcResult)
+	c.mu.Unlock()
+	for _, waiter := range pending {
+		waiter <- rpcResult{err: err}
+	}
+}
+
+// Call 发送请求并等待回复, 直到收到回复或ctx结束
+// 服务端处理失败返回 *RPCError, 没有服务端队列时返回 ErrUnroutable
+// 可通过 opts 设置优先级、headers等属性, 请求默认不持久化
+func (c *RPCClient) Call(ctx context.Context, queueExchange QueueExchange, body []byte, opts ...PublishOption) ([]byte, error) {
+	c.mu.Lock()
+	ready := c.ready
+	c.mu.Unlock()
+	select {
+	case <-ready:
+	case <-c.conn.done:
+		return nil, ErrRPCClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	correlationId := NewMessageID()
+	waiter := make(chan rpcResult, 1)
+
+	c.mu.Lock()
+	ch, replyQueue := c.ch, c.replyQueue
+	if ch == nil {
+		c.mu.Unlock()
+		return nil, ErrRPCConnectionLost
+	}
+	c.pending[correlationId] = waiter
+	c.mu.Unlock()
+
+	msg := amqp.Publishing{
+		ContentType:   ContentTypeText,
+		CorrelationId: correlationId,
+		ReplyTo:       replyQueue,
+		MessageId:     correlationId,
+		Timestamp:     time.Now(),
+		Body:          body,
+	}
+	// 请求在调用方放弃等待后过期, 避免服务端处理无意义的请求
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := time.Until(deadline).Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		msg.Expiration = strconv.FormatInt(ms, 10)
+	}
+	applyOptions(&msg, opts)
+	// 回复地址与关联ID由客户端维护, 不允许覆盖
+	msg.CorrelationId = correlationId
+	msg.ReplyTo = replyQueue
+	exchange, key := queueTopology(queueExchange).target()
+	span := startPublishSpan(ctx, exchange, key, &msg)
+	err := ch.Publish(exchange, key, true, false, msg)
+	finishSpan(span, err)
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, correlationId)
+		c.mu.Unlock()
+		return nil, &PublishError{Kind: err, Exchange: exchange, RoutingKey: key}
+	}
+
+	select {
+	case result := <-waiter:
+		return result.body, result.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, correlationId)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Close 关闭客户端, 等待中的调用返回 ErrRPCClosed
+func (c *RPCClient) Close() error {
+	return c.conn.Close()
+}
+
+// RPCHandler 请求处理接口, 返回值会发布到请求的 ReplyTo 队列
+type RPCHandler interface {
+	Options() QueueExchange
+	Reply(ctx context.Context, body []byte) ([]byte, error)
+}
+
+// Serve 启动RPC服务端, 复用 RecvCtx 的连接管理、中间件与优雅退出
+// 处理失败不会进入重试流程, 错误信息通过回复返回给客户端
+func Serve(ctx context.Context, handler RPCHandler, runNums int) error {
+	return RecvCtx(ctx, handler.Options(), &rpcReceiver{handler: handler}, runNums)
+}
+
+// rpcReceiver 将 RPCHandler 适配为 Receiver
+type rpcReceiver struct {
+	handler RPCHandler
+}
+
+// ConsumeDelivery 处理请求并回复
+func (r *rpcReceiver) ConsumeDelivery(ctx context.Context, d amqp.Delivery) error {
+	body, err := r.reply(ctx, d.Body)
+	if d.ReplyTo == "" {
+		// 没有回复地址, 视为单向消息
+		return nil
+	}
+	reply := amqp.Publishing{
+		ContentType:   d.ContentType,
+		CorrelationId: d.CorrelationId,
+		Timestamp:     time.Now(),
+		Body:          body,
+	}
+	if err != nil {
+		reply.Headers = amqp.Table{headerRPCError: err.Error()}
+		reply.Body = nil
+	}
+	q := r.handler.Options()
+	pubCtx, cancel := context.WithTimeout(detach(ctx), PublishTimeout)
+	defer cancel()
+	if sendErr := getPublisher(q.Dns).publishTo(pubCtx, "", d.ReplyTo, reply); sendErr != nil {
+		// 客户端可能已经超时退出, 回复失败不重试请求
+		log.Printf("[%s] RPC回复发送失败 :%s \n", q.QuName, sendErr)
+	}
+	return nil
+}
+
+// reply 调用处理函数, panic 转为错误回复给客户端
+func (r *rpcReceiver) reply(ctx context.Context, body []byte) (resp []byte, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+			log.Printf("[%s] RPC处理panic :%v \n%s", r.handler.Options().QuName, v, err.(*PanicError).Stack)
+		}
+	}()
+	return r.handler.Reply(ctx, body)
+}
+
+// Options Receiver接口实现
+func (r *rpcReceiver) Options() QueueExchange {
+	return r.handler.Options()
+}
+
+// Consumer Receiver接口实现, 实际由 ConsumeDelivery 处理
+func (r *rpcReceiver) Consumer(body []byte) error {
+	_, err := r.handler.Reply(context.Background(), body)
+	return err
+}
+
+// FailAction Receiver接口实现
+func (r *rpcReceiver) FailAction(error, []byte) error {
+	return nil
+}
+
+// Send Receiver接口实现, RPC服务端不支持
+func (r *rpcReceiver) Send(...interface{}) error {
+	return errors.New("rabbitmq: rpc server does not support Send")
+}
+
+// Recv Receiver接口实现
+func (r *rpcReceiver) Recv(runNums int) {
+	_ = Serve(context.Background(), r.handler, runNums)
+}
@@ -0,0 +1,486 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	utilredis "github.com/biwankaifa/go-util/redis"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/streadway/amqp"
+)
+
+// 顺序消费: 消息按分区key一致性哈希到 N 个分区队列, 相同key的消息进入同一个分区并按发布顺序消费
+// 分区队列开启 x-single-active-consumer, 同一时刻每个分区只有一个消费者在工作
+// 各实例通过redis登记心跳, 按成员列表划分分区, 实例加入或离开时重新分配
+
+// DefaultPartitions QueueExchange.Partitions 未设置时的分区数量
+var DefaultPartitions = 16
+
+// ShardKeyHeader 分区key所在的header, 发布时写入, 便于消费端与排查时查看
+var ShardKeyHeader = "x-shard-key"
+
+// ErrNoShardKey 未指定分区key且无法从消息中提取
+var ErrNoShardKey = errors.New("rabbitmq: shard key is empty")
+
+// ShardKeyFunc 从待发布的消息中提取分区key
+type ShardKeyFunc func(msg *amqp.Publishing) string
+
+// HeaderShardKey 使用指定header的值作为分区key, 如用户ID
+func HeaderShardKey(name string) ShardKeyFunc {
+	return func(msg *amqp.Publishing) string {
+		if v, ok := msg.Headers[name]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+}
+
+// Partition 分区key对应的分区序号, 范围 [0, n)
+// 使用 jump consistent hash, 分区数量调整时只有少量key会改变分区
+func Partition(key string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	k := h.Sum64()
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return int(b)
+}
+
+// ShardExchangeName 分区队列绑定的交换机名称
+func ShardExchangeName(queueExchange QueueExchange) string {
+	return queueExchange.QuName + ".sharded"
+}
+
+// PartitionQueueName 第 i 个分区队列的名称
+func PartitionQueueName(queueExchange QueueExchange, i int) string {
+	return fmt.Sprintf("%s_p%d", queueExchange.QuName, i)
+}
+
+// partitions 生效的分区数量
+func partitions(queueExchange QueueExchange) int {
+	if queueExchange.Partitions > 0 {
+		return queueExchange.Partitions
+	}
+	if DefaultPartitions > 0 {
+		return DefaultPartitions
+	}
+	return 1
+}
+
+// partitionQueueExchange 第 i 个分区的队列配置, 生产者与消费者使用相同的声明参数
+func partitionQueueExchange(queueExchange QueueExchange, i int) QueueExchange {
+	q := queueExchange
+	q.QuName = PartitionQueueName(queueExchange, i)
+	q.ExName = ShardExchangeName(queueExchange)
+	q.ExType = amqp.ExchangeDirect
+	q.RtKey = q.QuName
+	q.QueueArgs = copyTable(queueExchange.QueueArgs)
+	q.QueueArgs["x-single-active-consumer"] = true
+	return q
+}
+
+// SendOrdered 按分区key发送顺序消息, 相同key的消息按发送顺序消费, 等待broker确认, 超时时间为 PublishTimeout
+// key 为空时使用 QueueExchange.ShardKey 从消息中提取
+func SendOrdered(queueExchange QueueExchange, key string, msg string, opts ...PublishOption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	return SendOrderedCtx(ctx, queueExchange, key, msg, opts...)
+}
+
+// SendOrderedCtx 按分区key发送顺序消息, broker确认后返回
+func SendOrderedCtx(ctx context.Context, queueExchange QueueExchange, key string, msg string, opts ...PublishOption) error {
+	return getPublisher(queueExchange.Dns).PublishOrdered(ctx, queueExchange, key, msg, opts...)
+}
+
+// SendMessageOrdered 按分区key发送类型化的顺序消息
+func SendMessageOrdered(ctx context.Context, queueExchange QueueExchange, key string, m Message, opts ...PublishOption) error {
+	return getPublisher(queueExchange.Dns).PublishMessageOrdered(ctx, queueExchange, key, m, opts...)
+}
+
+// PublishOrdered 按分区key发布顺序消息, broker确认后返回
+func (p *Publisher) PublishOrdered(ctx context.Context, queueExchange QueueExchange, key string, msg string, opts ...PublishOption) error {
+	return p.publishOrdered(ctx, queueExchange, key, newPublishing(ContentTypeText, []byte(msg), opts...))
+}
+
+// PublishMessageOrdered 编码并按分区key发布类型化的顺序消息, broker确认后返回
+func (p *Publisher) PublishMessageOrdered(ctx context.Context, queueExchange QueueExchange, key string, m Message, opts ...PublishOption) error {
+	msg, err := m.publishing(opts...)
+	if err != nil {
+		return err
+	}
+	return p.publishOrdered(ctx, queueExchange, key, msg)
+}
+
+// publishOrdered 计算分区并发布到分区队列
+func (p *Publisher) publishOrdered(ctx context.Context, queueExchange QueueExchange, key string, msg amqp.Publishing) error {
+	if key == "" {
+		extract := queueExchange.ShardKey
+		if extract == nil {
+			extract = HeaderShardKey(ShardKeyHeader)
+		}
+		key = extract(&msg)
+	}
+	if key == "" {
+		return ErrNoShardKey
+	}
+	msg.Headers = copyTable(msg.Headers)
+	msg.Headers[ShardKeyHeader] = key
+	i := Partition(key, partitions(queueExchange))
+	return p.deliver(ctx, queueTopology(partitionQueueExchange(queueExchange, i)), msg)
+}
+
+// ShardOptions 顺序消费的分区协调配置
+type ShardOptions struct {
+	Client     *goredis.Client // redis客户端, 默认为 redis.Get()
+	Prefix     string          // 成员列表与分区占用key的前缀, 默认 mq:shard:
+	InstanceID string          // 当前实例标识, 默认 主机名-进程号-随机串
+	Heartbeat  time.Duration   // 心跳及重新分配的间隔, 默认3秒
+	TTL        time.Duration   // 心跳超时时间, 超时未续期的实例视为已离开, 默认10秒
+	Standalone bool            // 不使用redis协调, 当前实例监听全部分区, 多实例时各分区由broker选出一个消费者
+}
+
+// RecvOrdered 顺序消费者, 每个分配到的分区一个消费协程, ctx 结束时优雅退出
+//
+// 分区通过redis中的成员列表按 rendezvous hash 分配, 实例加入或离开后最长 TTL 内完成重新分配
+// 每个分区在redis中有占用记录, 旧消费者取消后在后台等待正在处理的消息完成, 之后才释放占用,
+// 新的所属实例占用成功后才开始消费, 同一分区不会被并发消费; 等待期间心跳照常进行
+// 实例崩溃时占用记录在 TTL 后过期, 未确认的消息由broker重新投递
+// redis不可用时监听全部分区(本实例仍在移交中的分区除外), 由 single-active-consumer 保证每个分区只有一个消费者在工作
+//
+// 处理失败进入重试队列的消息会排到同一分区后续消息之后, 需要严格顺序时处理函数应返回 Requeue 错误
+func RecvOrdered(ctx context.Context, queueExchange QueueExchange, receiver Receiver, opts ShardOptions) error {
+	if opts.Prefix == "" {
+		opts.Prefix = "mq:shard:"
+	}
+	if opts.InstanceID == "" {
+		host, _ := os.Hostname()
+		opts.InstanceID = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), NewMessageID()[:8])
+	}
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = 3 * time.Second
+	}
+	if opts.TTL <= opts.Heartbeat {
+		opts.TTL = 10 * time.Second
+		if opts.TTL <= opts.Heartbeat {
+			opts.TTL = 3 * opts.Heartbeat
+		}
+	}
+	if opts.Client == nil && !opts.Standalone {
+		opts.Client = utilredis.Get()
+	}
+
+	s := &shardConsumer{
+		queueExchange: queueExchange,
+		receiver:      receiver,
+		opts:          opts,
+		n:             partitions(queueExchange),
+		key:           opts.Prefix + queueExchange.QuName + ":members",
+		conn:          NewConnection(queueExchange.Dns),
+		workers:       make(map[int]*shardWorker),
+		draining:      make(map[int]*shardWorker),
+	}
+	if err := s.conn.Connect(); err != nil {
+		fmt.Printf("链接mq失败  :%s \n", err)
+	}
+	return s.run(ctx)
+}
+
+// shardConsumer 当前实例的分区消费协调
+type shardConsumer struct {
+	queueExchange QueueExchange
+	receiver      Receiver
+	opts          ShardOptions
+	n             int
+	key           string // redis成员列表
+	conn          *Connection
+
+	workers  map[int]*shardWorker // 正在消费的分区
+	draining map[int]*shardWorker // 已取消, 等待正在处理的消息完成的分区
+}
+
+// shardClaim 占用分区, 已被当前实例占用时续期
+var shardClaim = goredis.NewScript(`
+local v = redis.call("get", KEYS[1])
+if not v or v == ARGV[1] then
+	redis.call("set", KEYS[1], ARGV[1], "px", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// shardRelease 只释放当前实例的占用
+var shardRelease = goredis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// shardWorker 单个分区的消费协程
+type shardWorker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// run 定时心跳并调整消费的分区, ctx 结束后停止全部分区并退出登记
+func (s *shardConsumer) run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	if s.queueExchange.PollDepth && QueueDepthInterval > 0 {
+		queues := make([]string, s.n)
+		for i := range queues {
+			queues[i] = PartitionQueueName(s.queueExchange, i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			PollQueueDepth(ctx, s.queueExchange.Dns, QueueDepthInterval, queues...)
+		}()
+	}
+
+	ticker := time.NewTicker(s.opts.Heartbeat)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		s.rebalance(ctx, s.assign(ctx))
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	for i, w := range s.workers {
+		w.cancel()
+		s.draining[i] = w
+		delete(s.workers, i)
+	}
+	err := s.drain()
+	if !s.opts.Standalone {
+		rctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if e := s.opts.Client.ZRem(rctx, s.key, s.opts.InstanceID).Err(); e != nil {
+			log.Printf("[%s] 退出分区登记失败 :%s \n", s.queueExchange.QuName, e)
+		}
+		cancel()
+	}
+	wg.Wait()
+	_ = s.conn.Close()
+	return err
+}
+
+// drain 等待移交中的分区完成并释放占用, 最长 ShutdownTimeout
+// 超时未完成的分区不释放占用, 由 TTL 过期后再移交
+func (s *shardConsumer) drain() error {
+	t := time.NewTimer(ShutdownTimeout)
+	defer t.Stop()
+	for i, w := range s.draining {
+		select {
+		case <-w.done:
+		case <-t.C:
+			log.Printf("[%s] 等待分区消费者退出超时 \n", s.queueExchange.QuName)
+			return ErrShutdownTimeout
+		}
+		s.release(i)
+		delete(s.draining, i)
+	}
+	return nil
+}
+
+// assignment 一次心跳计算出的分区分配
+type assignment struct {
+	owned     []bool // 按成员列表应由当前实例消费的分区
+	available bool   // redis可用, 需要通过占用记录协调移交
+}
+
+// assign 续期心跳并计算当前实例应消费的分区, redis不可用时返回全部分区
+func (s *shardConsumer) assign(ctx context.Context) assignment {
+	a := assignment{owned: make([]bool, s.n), available: !s.opts.Standalone}
+	members, err := s.heartbeat(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[%s] 分区心跳失败, 监听全部分区 :%s \n", s.queueExchange.QuName, err)
+		}
+		members = nil
+		a.available = false
+	}
+	for i := range a.owned {
+		a.owned[i] = members == nil || owner(members, i) == s.opts.InstanceID
+	}
+	return a
+}
+
+// claimKey 分区占用记录的key
+func (s *shardConsumer) claimKey(i int) string {
+	return s.opts.Prefix + s.queueExchange.QuName + ":p" + strconv.Itoa(i)
+}
+
+// claim 占用或续期分区, 返回是否由当前实例占用
+func (s *shardConsumer) claim(ctx context.Context, ids []int) (map[int]bool, error) {
+	rctx, cancel := context.WithTimeout(ctx, s.opts.Heartbeat)
+	defer cancel()
+	pipe := s.opts.Client.Pipeline()
+	cmds := make(map[int]*goredis.Cmd, len(ids))
+	for _, i := range ids {
+		cmds[i] = shardClaim.Eval(rctx, pipe, []string{s.claimKey(i)}, s.opts.InstanceID, s.opts.TTL.Milliseconds())
+	}
+	if _, err := pipe.Exec(rctx); err != nil {
+		return nil, err
+	}
+	claimed := make(map[int]bool, len(ids))
+	for i, cmd := range cmds {
+		n, _ := cmd.Int64()
+		claimed[i] = n == 1
+	}
+	return claimed, nil
+}
+
+// release 释放分区占用, 新的所属实例下次心跳即可开始消费
+func (s *shardConsumer) release(i int) {
+	if s.opts.Standalone {
+		return
+	}
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shardRelease.Run(rctx, s.opts.Client, []string{s.claimKey(i)}, s.opts.InstanceID).Err(); err != nil {
+		log.Printf("[%s] 释放分区 %d 失败, 等待过期 :%s \n", s.queueExchange.QuName, i, err)
+	}
+}
+
+// heartbeat 写入当前实例的过期时间, 清除已过期的实例并返回存活的实例
+func (s *shardConsumer) heartbeat(ctx context.Context) ([]string, error) {
+	if s.opts.Standalone {
+		return nil, nil
+	}
+	rctx, cancel := context.WithTimeout(ctx, s.opts.Heartbeat)
+	defer cancel()
+	now := time.Now()
+	pipe := s.opts.Client.TxPipeline()
+	pipe.ZAdd(rctx, s.key, &goredis.Z{Score: float64(now.Add(s.opts.TTL).UnixMilli()), Member: s.opts.InstanceID})
+	pipe.ZRemRangeByScore(rctx, s.key, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	members := pipe.ZRange(rctx, s.key, 0, -1)
+	pipe.PExpire(rctx, s.key, 2*s.opts.TTL)
+	if _, err := pipe.Exec(rctx); err != nil {
+		return nil, err
+	}
+	return members.Val(), nil
+}
+
+// owner 分区所属的实例, 每个实例对分区打分取最高者, 实例变化时只移动该实例相关的分区
+func owner(members []string, partition int) string {
+	var best string
+	var bestScore uint64
+	for _, m := range members {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(m + "/" + strconv.Itoa(partition)))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+// rebalance 取消不再属于当前实例的分区, 启动新分配且已占用的分区, 不等待分区消费者退出
+func (s *shardConsumer) rebalance(ctx context.Context, a assignment) {
+	// 已退出的分区释放占用
+	for i, w := range s.draining {
+		select {
+		case <-w.done:
+			if a.available {
+				s.release(i)
+			}
+			delete(s.draining, i)
+		default:
+		}
+	}
+
+	var revoked []int
+	for i, w := range s.workers {
+		if !a.owned[i] {
+			revoked = append(revoked, i)
+			w.cancel()
+			s.draining[i] = w
+			delete(s.workers, i)
+		}
+	}
+	if len(revoked) > 0 {
+		log.Printf("[%s] 移交分区 %v \n", s.queueExchange.QuName, revoked)
+	}
+
+	var pending []int
+	for i, ok := range a.owned {
+		if ok && s.workers[i] == nil && s.draining[i] == nil {
+			pending = append(pending, i)
+		}
+	}
+	if !a.available {
+		for _, i := range pending {
+			if ctx.Err() == nil {
+				s.start(ctx, i)
+			}
+		}
+		return
+	}
+
+	// 续期正在消费与移交中的分区, 占用新分配的分区, 旧的所属实例释放之前占用会失败, 下次心跳再尝试
+	ids := append(s.owned(), pending...)
+	for i := range s.draining {
+		ids = append(ids, i)
+	}
+	claimed, err := s.claim(ctx, ids)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[%s] 分区占用失败 :%s \n", s.queueExchange.QuName, err)
+		}
+		return
+	}
+	for i, w := range s.workers {
+		if !claimed[i] {
+			// 占用已过期并被其他实例获取, 停止消费
+			log.Printf("[%s] 分区 %d 已被其他实例占用 \n", s.queueExchange.QuName, i)
+			w.cancel()
+			s.draining[i] = w
+			delete(s.workers, i)
+		}
+	}
+	for _, i := range pending {
+		if claimed[i] && ctx.Err() == nil {
+			s.start(ctx, i)
+		}
+	}
+}
+
+// start 启动分区消费协程, 与其他分区共享连接
+// 预取数量固定为1, 分区移交时不会有已预取的消息在新消费者之后才重新入队
+func (s *shardConsumer) start(ctx context.Context, i int) {
+	wctx, cancel := context.WithCancel(ctx)
+	w := &shardWorker{cancel: cancel, done: make(chan struct{})}
+	s.workers[i] = w
+	q := partitionQueueExchange(s.queueExchange, i)
+	q.Prefetch = 1
+	mq := NewMq(q)
+	mq.conn = s.conn
+	go func() {
+		defer close(w.done)
+		mq.ListenReceiverCtx(wctx, s.receiver, i)
+	}()
+}
+
+// owned 正在消费的分区
+func (s *shardConsumer) owned() []int {
+	ids := make([]int, 0, len(s.workers))
+	for i := range s.workers {
+		ids = append(ids, i)
+	}
+	return ids
+}
@@ -0,0 +1,109 @@
+package rabbitmq
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/streadway/amqp"
+)
+
+// startOrdered 通过 RecvOrdered 启动顺序消费者, 测试结束时优雅退出
+func startOrdered(t *testing.T, r *testReceiver, opts ShardOptions) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = RecvOrdered(ctx, r.qe, r, opts)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestRecvOrderedHandoffWaitsForHandler(t *testing.T) {
+	b := newTestBroker(t)
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	qe := QueueExchange{QuName: "ordered", Partitions: 4, Dns: b.DNS()}
+	opts := ShardOptions{Client: client, Heartbeat: 20 * time.Millisecond, TTL: 200 * time.Millisecond}
+
+	// 找到一个加入实例b后会移交给b的分区及落在该分区的key
+	p := -1
+	for i := 0; i < qe.Partitions; i++ {
+		if owner([]string{"a", "b"}, i) == "b" {
+			p = i
+			break
+		}
+	}
+	if p < 0 {
+		t.Fatal("no partition moves to instance b")
+	}
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := "user" + strconv.Itoa(i); Partition(k, qe.Partitions) == p {
+			key = k
+		}
+	}
+	claimKey := "mq:shard:ordered:p" + strconv.Itoa(p)
+
+	unblock := make(chan struct{})
+	a := &testReceiver{qe: qe, handle: func(d amqp.Delivery) error {
+		if string(d.Body) == "first" {
+			<-unblock
+		}
+		return nil
+	}}
+	optsA := opts
+	optsA.InstanceID = "a"
+	startOrdered(t, a, optsA)
+	waitFor(t, "partition queues", func() bool { return len(b.Queues()) == qe.Partitions })
+
+	if err := SendOrdered(qe, key, "first"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a handling first", func() bool { return len(a.deliveries()) == 1 })
+
+	bb := &testReceiver{qe: qe}
+	optsB := opts
+	optsB.InstanceID = "b"
+	startOrdered(t, bb, optsB)
+	if err := SendOrdered(qe, key, "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 处理中的消息未完成时, a 继续心跳且不释放分区, b 不开始消费
+	time.Sleep(3 * opts.TTL)
+	if _, err := client.ZScore(context.Background(), "mq:shard:ordered:members", "a").Result(); err != nil {
+		t.Fatalf("instance a stopped heartbeating while draining: %v", err)
+	}
+	if v, _ := client.Get(context.Background(), claimKey).Result(); v != "a" {
+		t.Fatalf("claim = %q while a is still handling, want a", v)
+	}
+	if got := bb.bodies(); len(got) != 0 {
+		t.Fatalf("b consumed %v before a finished", got)
+	}
+
+	close(unblock)
+	waitFor(t, "b consuming second", func() bool { return len(bb.deliveries()) == 1 })
+	if got := bb.bodies(); got[0] != "second" {
+		t.Fatalf("b got %v, want [second]", got)
+	}
+	if got := a.bodies(); len(got) != 1 {
+		t.Fatalf("a got %v, want [first]", got)
+	}
+	if v, _ := client.Get(context.Background(), claimKey).Result(); v != "b" {
+		t.Fatalf("claim = %q after handoff, want b", v)
+	}
+}
@@ -0,0 +1,755 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrSpoolFull 本地缓存已达到 SpoolOptions.MaxSize
+	ErrSpoolFull = errors.New("rabbitmq: spool is full")
+	// ErrSpoolClosed 本地缓存已关闭
+	ErrSpoolClosed = errors.New("rabbitmq: spool closed")
+)
+
+// SpoolSync 本地缓存的刷盘策略
+type SpoolSync int
+
+const (
+	SpoolSyncAlways   SpoolSync = iota // 每条消息写入后fsync, 宕机不丢消息
+	SpoolSyncInterval                  // 每隔 SyncInterval fsync一次, 宕机最多丢失一个间隔内的消息
+	SpoolSyncNever                     // 由操作系统决定, 只保证进程崩溃不丢消息
+)
+
+// SpoolOptions 本地缓存配置
+type SpoolOptions struct {
+	Dir           string        // 缓存目录, 每个连接地址需使用独立目录
+	SegmentSize   int64         // 单个段文件大小, 默认16MB
+	MaxSize       int64         // 所有段文件总大小上限, 超过后发送返回 ErrSpoolFull, 默认1GB
+	Sync          SpoolSync     // 刷盘策略, 默认 SpoolSyncAlways
+	SyncInterval  time.Duration // SpoolSyncInterval 的间隔, 默认1秒
+	RetryInterval time.Duration // 重新发布失败后的重试间隔, 默认1秒
+}
+
+// SpoolStats 本地缓存状态
+type SpoolStats struct {
+	Pending  int64  // 待重新发布的消息数量
+	Bytes    int64  // 段文件总大小
+	Segments int    // 段文件数量
+	Spooled  uint64 // 累计写入的消息数量
+	Flushed  uint64 // 累计重新发布成功的消息数量
+	Dropped  uint64 // 累计被broker拒绝或无法解析而丢弃的消息数量
+}
+
+// 段文件与读取位置文件
+const (
+	spoolSegmentExt  = ".seg"
+	spoolCursorFile  = "cursor"
+	spoolHeaderSize  = 8   // 4字节长度 + 4字节crc32
+	spoolCursorEvery = 100 // 每重新发布多少条消息保存一次读取位置
+)
+
+// Spool 发布失败时的本地磁盘缓存, 连接恢复后由后台协程按写入顺序重新发布
+//
+// 缓存中有待发布的消息时, 新消息也写入缓存, 保证顺序; 写入缓存即视为发送成功
+// 读取位置定期保存, 进程崩溃后可能重复发布少量消息, 消费者需按 MessageId 去重
+type Spool struct {
+	opts SpoolOptions
+	p    *Publisher
+
+	mu       sync.Mutex
+	segments []uint64         // 段序号, 升序
+	ends     map[uint64]int64 // 每个段有效数据的结尾
+	w        *os.File         // 当前写入段
+	r        *os.File         // 当前读取段
+	rseq     uint64
+	roff     int64
+	unsaved  int // 读取位置未保存的消息数量
+	dirty    bool
+	closed   bool
+	bytes    int64
+	stats    SpoolStats
+	wake     chan struct{}
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// spoolRecord 缓存中的一条消息, 包含重新发布时需要声明的拓扑
+// headers 与参数使用gob编码, 保留 time.Time、int32 等AMQP字段类型, 重新发布后与直接发布的消息一致
+type spoolRecord struct {
+	Exchange        string        `json:"exchange,omitempty"`
+	ExchangeType    string        `json:"exchange_type,omitempty"`
+	ExchangeArgs    []byte        `json:"exchange_args,omitempty"`
+	Queue           string        `json:"queue,omitempty"`
+	RoutingKey      string        `json:"routing_key,omitempty"`
+	QueueArgs       []byte        `json:"queue_args,omitempty"`
+	Skip            bool          `json:"skip,omitempty"`
+	Redeclare       time.Duration `json:"redeclare,omitempty"`
+	Delayed         bool          `json:"delayed,omitempty"` // 拓扑为目标队列, 重新发布时按 x-delay-until 选择延迟方式
+	Headers         []byte        `json:"headers,omitempty"`
+	ContentType     string        `json:"content_type,omitempty"`
+	ContentEncoding string        `json:"content_encoding,omitempty"`
+	DeliveryMode    uint8         `json:"delivery_mode,omitempty"`
+	Priority        uint8         `json:"priority,omitempty"`
+	CorrelationId   string        `json:"correlation_id,omitempty"`
+	ReplyTo         string        `json:"reply_to,omitempty"`
+	Expiration      string        `json:"expiration,omitempty"`
+	MessageId       string        `json:"message_id,omitempty"`
+	Timestamp       time.Time     `json:"timestamp"`
+	Type            string        `json:"type,omitempty"`
+	AppId           string        `json:"app_id,omitempty"`
+	Body            []byte        `json:"body"`
+}
+
+func init() {
+	// amqp.Table 中可能出现的非基础类型, gob编码interface需要注册
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(amqp.Decimal{})
+	gob.Register(time.Time{})
+}
+
+// EnableSpool 为 Send 使用的共享生产者开启本地缓存
+func EnableSpool(dns string, opts SpoolOptions) (*Spool, error) {
+	return getPublisher(dns).EnableSpool(opts)
+}
+
+// EnableSpool 开启本地缓存, 目录中已有的消息会在连接可用后重新发布
+// Publish/PublishMessage/PublishDelayed 因连接不可用失败时写入缓存
+func (p *Publisher) EnableSpool(opts SpoolOptions) (*Spool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.spool != nil {
+		return p.spool, nil
+	}
+	s, err := openSpool(p, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.spool = s
+	go s.run()
+	return s, nil
+}
+
+// openSpool 打开缓存目录, 校验已有段文件并截断未写完整的结尾
+func openSpool(p *Publisher, opts SpoolOptions) (*Spool, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("rabbitmq: spool dir is required")
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 16 << 20
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 1 << 30
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		opts:     opts,
+		p:        p,
+		ends:     make(map[uint64]int64),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+
+	files, err := ioutil.ReadDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	s.rseq, s.roff = s.loadCursor()
+	for len(s.segments) > 0 && s.segments[0] < s.rseq {
+		_ = os.Remove(s.path(s.segments[0]))
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) == 0 {
+		s.segments = []uint64{s.rseq + 1}
+		s.rseq, s.roff = s.rseq+1, 0
+	} else if s.segments[0] != s.rseq {
+		s.rseq, s.roff = s.segments[0], 0
+	}
+
+	for i, seq := range s.segments {
+		from := int64(0)
+		if seq == s.rseq {
+			from = s.roff
+		}
+		count, end, size, err := scanSegment(s.path(seq), from)
+		if err != nil {
+			return nil, err
+		}
+		if end < size {
+			if i == len(s.segments)-1 {
+				// 最后一个段结尾未写完整, 截断后继续追加
+				log.Printf("[spool] 段文件 %s 结尾不完整, 截断 %d 字节 \n", s.path(seq), size-end)
+				if err = os.Truncate(s.path(seq), end); err != nil {
+					return nil, err
+				}
+				size = end
+			} else {
+				log.Printf("[spool] 段文件 %s 在 %d 处损坏, 跳过之后的数据 \n", s.path(seq), end)
+			}
+		}
+		s.ends[seq] = end
+		s.bytes += size
+		s.stats.Pending += int64(count)
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if s.w, err = os.OpenFile(s.path(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	s.report()
+	return s, nil
+}
+
+// scanSegment 从 from 开始校验段文件, 返回有效消息数量、有效数据结尾与文件大小
+func scanSegment(path string, from int64) (count int, end int64, size int64, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	size = info.Size()
+	end = from
+	for {
+		_, n, err := readRecord(f, end, size)
+		if err != nil {
+			return count, end, size, nil
+		}
+		end += n
+		count++
+	}
+}
+
+// readRecord 读取 off 处的一条消息, limit 为可读取的结尾
+func readRecord(f *os.File, off, limit int64) ([]byte, int64, error) {
+	if off+spoolHeaderSize > limit {
+		return nil, 0, io.EOF
+	}
+	header := make([]byte, spoolHeaderSize)
+	if _, err := f.ReadAt(header, off); err != nil {
+		return nil, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if off+spoolHeaderSize+length > limit {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, off+spoolHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New("rabbitmq: spool record checksum mismatch")
+	}
+	return payload, spoolHeaderSize + length, nil
+}
+
+// path 段文件路径
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.opts.Dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// loadCursor 读取上次保存的读取位置
+func (s *Spool) loadCursor() (uint64, int64) {
+	b, err := ioutil.ReadFile(filepath.Join(s.opts.Dir, spoolCursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	var seq uint64
+	var off int64
+	if _, err = fmt.Sscanf(string(b), "%d %d", &seq, &off); err != nil {
+		return 0, 0
+	}
+	return seq, off
+}
+
+// saveCursor 保存读取位置, 先写临时文件再重命名, 需持有锁
+func (s *Spool) saveCursor() {
+	if s.unsaved == 0 {
+		return
+	}
+	name := filepath.Join(s.opts.Dir, spoolCursorFile)
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.rseq, s.roff)), 0644); err != nil {
+		log.Printf("[spool] 保存读取位置失败 :%s \n", err)
+		return
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		log.Printf("[spool] 保存读取位置失败 :%s \n", err)
+		return
+	}
+	s.unsaved = 0
+}
+
+// Stats 本地缓存状态
+func (s *Spool) Stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Bytes = s.bytes
+	stats.Segments = len(s.segments)
+	return stats
+}
+
+// Pending 待重新发布的消息数量
+func (s *Spool) Pending() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats.Pending
+}
+
+// append 写入一条消息, ctx中的span会注入消息headers
+// delayed 为true时 t 为目标队列的拓扑, 延迟方式在重新发布时确定
+func (s *Spool) append(ctx context.Context, t topology, msg amqp.Publishing, delayed bool) error {
+	headers := copyTable(msg.Headers)
+	injectSpan(ctx, headers)
+	if msg.MessageId == "" {
+		msg.MessageId = NewMessageID()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	rec, err := newSpoolRecord(t, msg, headers)
+	if err != nil {
+		return err
+	}
+	rec.Delayed = delayed
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[spoolHeaderSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSpoolClosed
+	}
+	size := int64(len(frame))
+	if s.bytes+size > s.opts.MaxSize {
+		return ErrSpoolFull
+	}
+	wseq := s.segments[len(s.segments)-1]
+	if s.ends[wseq] > 0 && s.ends[wseq]+size > s.opts.SegmentSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+		wseq = s.segments[len(s.segments)-1]
+	}
+	if _, err = s.w.Write(frame); err != nil {
+		// 去掉写了一半的数据
+		_ = s.w.Truncate(s.ends[wseq])
+		return err
+	}
+	if s.opts.Sync == SpoolSyncAlways {
+		if err = s.w.Sync(); err != nil {
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+	s.ends[wseq] += size
+	s.bytes += size
+	s.stats.Pending++
+	s.stats.Spooled++
+	s.report()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate 关闭当前写入段并创建新段, 需持有锁
+func (s *Spool) rotate() error {
+	if err := s.w.Sync(); err != nil {
+		return err
+	}
+	_ = s.w.Close()
+	seq := s.segments[len(s.segments)-1] + 1
+	w, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		// 重新打开原段文件, 保证后续仍可写入
+		s.w, _ = os.OpenFile(s.path(seq-1), os.O_WRONLY|os.O_APPEND, 0644)
+		return err
+	}
+	s.w = w
+	s.dirty = false
+	s.segments = append(s.segments, seq)
+	s.ends[seq] = 0
+	return nil
+}
+
+// next 读取下一条待发布的消息, 读完的段文件会被删除, 没有消息时返回 io.EOF
+func (s *Spool) next() ([]byte, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.closed {
+			return nil, 0, ErrSpoolClosed
+		}
+		end := s.ends[s.rseq]
+		if s.roff >= end {
+			if s.rseq == s.segments[len(s.segments)-1] {
+				return nil, 0, io.EOF
+			}
+			s.removeHead()
+			continue
+		}
+		if s.r == nil {
+			r, err := os.Open(s.path(s.rseq))
+			if err != nil {
+				return nil, 0, err
+			}
+			s.r = r
+		}
+		payload, n, err := readRecord(s.r, s.roff, end)
+		if err != nil {
+			// 启动时已校验, 运行中读取失败说明文件被破坏, 跳过该段剩余数据
+			log.Printf("[spool] 读取 %s 失败, 跳过该段剩余数据 :%s \n", s.path(s.rseq), err)
+			s.ends[s.rseq] = s.roff
+			continue
+		}
+		return payload, n, nil
+	}
+}
+
+// removeHead 删除已读完的段文件并移动到下一个段, 需持有锁
+func (s *Spool) removeHead() {
+	if s.r != nil {
+		_ = s.r.Close()
+		s.r = nil
+	}
+	path := s.path(s.rseq)
+	if info, err := os.Stat(path); err == nil {
+		s.bytes -= info.Size()
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("[spool] 删除段文件失败 :%s \n", err)
+	}
+	delete(s.ends, s.rseq)
+	s.segments = s.segments[1:]
+	s.rseq, s.roff = s.segments[0], 0
+	s.unsaved++
+	s.saveCursor()
+	s.report()
+}
+
+// commit 消息已重新发布或已丢弃, 移动读取位置
+func (s *Spool) commit(n int64, dropped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roff += n
+	s.stats.Pending--
+	if dropped {
+		s.stats.Dropped++
+	} else {
+		s.stats.Flushed++
+	}
+	s.unsaved++
+	if s.unsaved >= spoolCursorEvery {
+		s.saveCursor()
+	}
+	s.report()
+}
+
+// report 上报缓存深度, 需持有锁
+func (s *Spool) report() {
+	metrics().SetSpoolDepth(s.p.conn.addr, s.stats.Pending, s.bytes)
+}
+
+// run 后台协程, 连接可用时按顺序重新发布缓存中的消息
+func (s *Spool) run() {
+	defer close(s.finished)
+	events := s.p.conn.NotifyState(make(chan StateEvent, 8))
+	retry := time.NewTicker(s.opts.RetryInterval)
+	defer retry.Stop()
+	var syncC <-chan time.Time
+	if s.opts.Sync == SpoolSyncInterval {
+		t := time.NewTicker(s.opts.SyncInterval)
+		defer t.Stop()
+		syncC = t.C
+	}
+	for {
+		s.flush()
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		case <-events:
+		case <-retry.C:
+		case <-syncC:
+			s.sync()
+		}
+	}
+}
+
+// flush 重新发布缓存中的消息, 直到缓存为空或连接不可用
+func (s *Spool) flush() {
+	defer func() {
+		s.mu.Lock()
+		s.saveCursor()
+		s.mu.Unlock()
+	}()
+	for s.p.conn.State() == StateConnected {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		payload, n, err := s.next()
+		if err != nil {
+			if err != io.EOF && err != ErrSpoolClosed {
+				log.Printf("[spool] 读取缓存失败 :%s \n", err)
+			}
+			return
+		}
+		rec, err := decodeSpoolRecord(payload)
+		if err != nil {
+			log.Printf("[spool] 消息解析失败, 丢弃 :%s \n", err)
+			s.commit(n, true)
+			continue
+		}
+		msg := rec.msg
+		ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+		span, ctx := startFollowSpan(ctx, "rabbitmq.spool", msg.Headers)
+		err = s.replay(ctx, rec)
+		finishSpan(span, err)
+		cancel()
+		if err != nil && spoolable(err) {
+			return
+		}
+		if err != nil {
+			// broker明确拒绝, 重试也不会成功
+			log.Printf("[spool] 消息 %s 被broker拒绝, 丢弃 :%s \n", msg.MessageId, err)
+		}
+		s.commit(n, err != nil)
+	}
+}
+
+// replay 重新发布一条消息, 延迟消息按剩余的延迟选择方式, 已到期的直接投递到目标队列
+func (s *Spool) replay(ctx context.Context, rec spooled) error {
+	if !rec.delayed {
+		return s.p.publish(ctx, rec.t, rec.msg)
+	}
+	until, _ := rec.msg.Headers[headerDelayUntil].(time.Time)
+	d := time.Until(until)
+	if d <= 0 {
+		return s.p.publish(ctx, rec.t, rec.msg)
+	}
+	msg := rec.msg
+	msg.Headers = copyTable(msg.Headers)
+	t, err := s.p.delayTarget(ctx, rec.t.queueExchange(s.p.conn.dns), msg, d)
+	if err != nil {
+		return err
+	}
+	return s.p.publish(ctx, t, msg)
+}
+
+// sync 将写入的数据刷到磁盘
+func (s *Spool) sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty || s.closed {
+		return
+	}
+	if err := s.w.Sync(); err != nil {
+		log.Printf("[spool] 刷盘失败 :%s \n", err)
+		return
+	}
+	s.dirty = false
+}
+
+// Close 停止后台协程, 刷盘并关闭文件, 未发布的消息在下次打开时继续发布
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+	<-s.finished
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saveCursor()
+	if s.r != nil {
+		_ = s.r.Close()
+	}
+	err := s.w.Sync()
+	if closeErr := s.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// spoolable 连接不可用导致的发布失败, 可以写入缓存稍后重新发布
+func spoolable(err error) bool {
+	if errors.Is(err, ErrNotConnected) || errors.Is(err, ErrPublishTimeout) || errors.Is(err, amqp.ErrClosed) {
+		return true
+	}
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && (!amqpErr.Server || amqpErr.Code == amqp.ConnectionForced)
+}
+
+// newSpoolRecord 将拓扑与消息转换为缓存记录
+func newSpoolRecord(t topology, msg amqp.Publishing, headers amqp.Table) (*spoolRecord, error) {
+	rec := &spoolRecord{
+		Exchange:        t.exchange,
+		ExchangeType:    t.exchangeType,
+		Queue:           t.queue,
+		RoutingKey:      t.routingKey,
+		Skip:            t.skip,
+		Redeclare:       t.redeclare,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+	var err error
+	if rec.ExchangeArgs, err = marshalTable(t.exchangeArgs); err != nil {
+		return nil, err
+	}
+	if rec.QueueArgs, err = marshalTable(t.queueArgs); err != nil {
+		return nil, err
+	}
+	if rec.Headers, err = marshalTable(headers); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// spooled 从缓存还原的消息
+type spooled struct {
+	t       topology
+	msg     amqp.Publishing
+	delayed bool
+}
+
+// decodeSpoolRecord 还原拓扑与消息
+func decodeSpoolRecord(payload []byte) (spooled, error) {
+	rec := &spoolRecord{}
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return spooled{}, err
+	}
+	exchangeArgs, err := unmarshalTable(rec.ExchangeArgs)
+	if err != nil {
+		return spooled{}, err
+	}
+	queueArgs, err := unmarshalTable(rec.QueueArgs)
+	if err != nil {
+		return spooled{}, err
+	}
+	headers, err := unmarshalTable(rec.Headers)
+	if err != nil {
+		return spooled{}, err
+	}
+	t := topology{
+		exchange:     rec.Exchange,
+		exchangeType: rec.ExchangeType,
+		exchangeArgs: exchangeArgs,
+		queue:        rec.Queue,
+		routingKey:   rec.RoutingKey,
+		queueArgs:    queueArgs,
+		skip:         rec.Skip,
+		redeclare:    rec.Redeclare,
+	}
+	msg := amqp.Publishing{
+		Headers:         headers,
+		ContentType:     rec.ContentType,
+		ContentEncoding: rec.ContentEncoding,
+		DeliveryMode:    rec.DeliveryMode,
+		Priority:        rec.Priority,
+		CorrelationId:   rec.CorrelationId,
+		ReplyTo:         rec.ReplyTo,
+		Expiration:      rec.Expiration,
+		MessageId:       rec.MessageId,
+		Timestamp:       rec.Timestamp,
+		Type:            rec.Type,
+		AppId:           rec.AppId,
+		Body:            rec.Body,
+	}
+	return spooled{t: t, msg: msg, delayed: rec.Delayed}, nil
+}
+
+// marshalTable gob编码 amqp.Table, 保留字段的具体类型
+func marshalTable(t amqp.Table) ([]byte, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(t); err != nil {
+		return nil, fmt.Errorf("rabbitmq: encode table: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalTable 解码 marshalTable 的结果
+func unmarshalTable(b []byte) (amqp.Table, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var t amqp.Table
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&t); err != nil {
+		return nil, fmt.Errorf("rabbitmq: decode table: %w", err)
+	}
+	return t, nil
+}
@@ -0,0 +1,84 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestSpoolRecordRoundTrip(t *testing.T) {
+	until := time.Now().Add(time.Hour).Round(0)
+	qe := QueueExchange{QuName: "remind", Dns: "memory://spool"}
+	topo := delayTopology(qe, "delay", time.Minute)
+	topo.exchangeArgs = amqp.Table{"x-delayed-type": amqp.ExchangeDirect}
+	msg := amqp.Publishing{
+		Headers: amqp.Table{
+			headerDelayUntil: until,
+			headerDelayTTL:   true,
+			"retry_nums":     int32(2),
+			"count":          int64(7),
+			"ratio":          1.5,
+			"raw":            []byte("raw"),
+			"price":          amqp.Decimal{Scale: 2, Value: 1999},
+			"empty":          nil,
+			"nested": amqp.Table{
+				"at":    until,
+				"level": int16(3),
+				"tags":  []interface{}{"a", int32(1), amqp.Table{"deep": true}},
+			},
+		},
+		ContentType:  ContentTypeJSON,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    "id-1",
+		Timestamp:    time.Unix(1700000000, 0),
+		Body:         []byte(`{"id":1}`),
+	}
+
+	rec, err := newSpoolRecord(topo, msg, msg.Headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spooled, err := decodeSpoolRecord(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotTopo, got := spooled.t, spooled.msg
+
+	if !reflect.DeepEqual(gotTopo, topo) {
+		t.Fatalf("topology = %#v, want %#v", gotTopo, topo)
+	}
+	if gotTopo.redeclare == 0 {
+		t.Fatal("redeclare was not persisted")
+	}
+	if !reflect.DeepEqual(got.Headers, msg.Headers) {
+		t.Fatalf("headers = %#v, want %#v", got.Headers, msg.Headers)
+	}
+	got.Headers, msg.Headers = nil, nil
+	if !got.Timestamp.Equal(msg.Timestamp) {
+		t.Fatalf("timestamp = %s, want %s", got.Timestamp, msg.Timestamp)
+	}
+	got.Timestamp, msg.Timestamp = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got, msg) {
+		t.Fatalf("publishing = %#v, want %#v", got, msg)
+	}
+
+	// 重新发布后延迟与重试次数仍然生效
+	again, err := decodeSpoolRecord(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := amqp.Delivery{Headers: again.msg.Headers}
+	if remaining := delayRemaining(d); remaining < 59*time.Minute {
+		t.Fatalf("delayRemaining = %s after replay, want about 1h", remaining)
+	}
+	if n := retryCount(d); n != 2 {
+		t.Fatalf("retryCount = %d after replay, want 2", n)
+	}
+}
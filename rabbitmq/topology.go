@@ -0,0 +1,503 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/biwankaifa/go-util/config"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// ExchangeSpec 交换机定义
+type ExchangeSpec struct {
+	Name       string                 `mapstructure:"name"`
+	Type       string                 `mapstructure:"type"`    // direct/fanout/topic/headers, 默认 direct
+	Durable    *bool                  `mapstructure:"durable"` // 默认 true
+	AutoDelete bool                   `mapstructure:"auto_delete"`
+	Internal   bool                   `mapstructure:"internal"`
+	Arguments  map[string]interface{} `mapstructure:"arguments"`
+}
+
+// QueueSpec 队列定义, 常用参数提供了独立字段, 其他参数通过 Arguments 设置
+type QueueSpec struct {
+	Name                 string                 `mapstructure:"name"`
+	Durable              *bool                  `mapstructure:"durable"` // 默认 true
+	AutoDelete           bool                   `mapstructure:"auto_delete"`
+	Exclusive            bool                   `mapstructure:"exclusive"`
+	Type                 string                 `mapstructure:"type"`             // classic/quorum/stream, 对应 x-queue-type
+	MaxLength            int64                  `mapstructure:"max_length"`       // x-max-length
+	MaxLengthBytes       int64                  `mapstructure:"max_length_bytes"` // x-max-length-bytes
+	Overflow             string                 `mapstructure:"overflow"`         // drop-head/reject-publish/reject-publish-dlx, 对应 x-overflow
+	Lazy                 bool                   `mapstructure:"lazy"`             // x-queue-mode=lazy
+	MessageTTL           time.Duration          `mapstructure:"message_ttl"`      // x-message-ttl, 使用时长字符串如 "60s", 纯数字会按纳秒解析
+	MessageTTLMs         int64                  `mapstructure:"message_ttl_ms"`   // x-message-ttl 的毫秒数, 与 message_ttl 二选一
+	DeadLetterExchange   string                 `mapstructure:"dead_letter_exchange"`
+	DeadLetterRoutingKey string                 `mapstructure:"dead_letter_routing_key"`
+	MaxPriority          uint8                  `mapstructure:"max_priority"` // x-max-priority
+	SingleActiveConsumer bool                   `mapstructure:"single_active_consumer"`
+	Arguments            map[string]interface{} `mapstructure:"arguments"`
+}
+
+// BindingSpec 绑定定义, 一个绑定可以包含多个路由key
+// headers 交换机使用 Headers 与 Match 匹配, 不需要路由key
+type BindingSpec struct {
+	Queue       string                 `mapstructure:"queue"`
+	Exchange    string                 `mapstructure:"exchange"`
+	RoutingKeys []string               `mapstructure:"routing_keys"`
+	Headers     map[string]interface{} `mapstructure:"headers"`
+	Match       string                 `mapstructure:"match"` // all/any, 对应 x-match, 默认 all
+}
+
+// Topology 交换机、队列与绑定的声明式定义
+type Topology struct {
+	Exchanges []ExchangeSpec `mapstructure:"exchanges"`
+	Queues    []QueueSpec    `mapstructure:"queues"`
+	Bindings  []BindingSpec  `mapstructure:"bindings"`
+}
+
+// LoadTopology 从viper配置中读取拓扑定义, key 为配置路径, 如 rabbitmq.topology
+//
+//	[[rabbitmq.topology.queues]]
+//	name = "order"
+//	type = "quorum"
+//	max_length = 100000
+//	overflow = "reject-publish"
+//	message_ttl = "24h"
+func LoadTopology(v *viper.Viper, key string) (*Topology, error) {
+	if v == nil {
+		return nil, errors.New("rabbitmq: config not initialized")
+	}
+	t := &Topology{}
+	if err := v.UnmarshalKey(key, t); err != nil {
+		return nil, err
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// TopologyFromConfig 从 config.DefaultConfig 中读取拓扑定义
+func TopologyFromConfig(key string) (*Topology, error) {
+	return LoadTopology(config.DefaultConfig, key)
+}
+
+// Validate 校验定义是否完整
+func (t *Topology) Validate() error {
+	exchanges := make(map[string]ExchangeSpec, len(t.Exchanges))
+	for _, e := range t.Exchanges {
+		if e.Name == "" {
+			return errors.New("rabbitmq: exchange name is required")
+		}
+		switch e.kind() {
+		case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+		default:
+			if !strings.HasPrefix(e.kind(), "x-") {
+				return fmt.Errorf("rabbitmq: exchange %q has unknown type %q", e.Name, e.Type)
+			}
+		}
+		exchanges[e.Name] = e
+	}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			return errors.New("rabbitmq: queue name is required")
+		}
+		switch {
+		case q.MessageTTL < 0 || q.MessageTTLMs < 0:
+			return fmt.Errorf("rabbitmq: queue %q has negative message ttl", q.Name)
+		case q.MessageTTL > 0 && q.MessageTTLMs > 0:
+			return fmt.Errorf("rabbitmq: queue %q sets both message_ttl and message_ttl_ms", q.Name)
+		case q.MessageTTL > 0 && q.MessageTTL < time.Millisecond:
+			// 配置中的纯数字会被当作纳秒, 换算为毫秒后为0
+			return fmt.Errorf("rabbitmq: queue %q message_ttl %s is below 1ms, use a duration string like \"60s\" or message_ttl_ms", q.Name, q.MessageTTL)
+		}
+	}
+	for _, b := range t.Bindings {
+		if b.Queue == "" || b.Exchange == "" {
+			return errors.New("rabbitmq: binding requires queue and exchange")
+		}
+		e, ok := exchanges[b.Exchange]
+		if ok && e.kind() == amqp.ExchangeHeaders {
+			if len(b.Headers) == 0 {
+				return fmt.Errorf("rabbitmq: binding %s -> %s requires headers", b.Exchange, b.Queue)
+			}
+		} else if len(b.RoutingKeys) == 0 && (!ok || e.kind() != amqp.ExchangeFanout) {
+			return fmt.Errorf("rabbitmq: binding %s -> %s requires routing_keys", b.Exchange, b.Queue)
+		}
+	}
+	return nil
+}
+
+func (e ExchangeSpec) kind() string {
+	if e.Type == "" {
+		return amqp.ExchangeDirect
+	}
+	return e.Type
+}
+
+func (e ExchangeSpec) durable() bool {
+	return e.Durable == nil || *e.Durable
+}
+
+func (q QueueSpec) durable() bool {
+	return q.Durable == nil || *q.Durable
+}
+
+// messageTTL 消息过期时间的毫秒数
+func (q QueueSpec) messageTTL() int64 {
+	if q.MessageTTLMs > 0 {
+		return q.MessageTTLMs
+	}
+	return q.MessageTTL.Milliseconds()
+}
+
+// args 合并独立字段与 Arguments 为队列参数
+func (q QueueSpec) args() amqp.Table {
+	args := make(amqp.Table, len(q.Arguments)+4)
+	for k, v := range q.Arguments {
+		args[k] = v
+	}
+	if q.Type != "" {
+		args["x-queue-type"] = q.Type
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = q.MaxLength
+	}
+	if q.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = q.MaxLengthBytes
+	}
+	if q.Overflow != "" {
+		args["x-overflow"] = q.Overflow
+	}
+	if q.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+	if ttl := q.messageTTL(); ttl > 0 {
+		args["x-message-ttl"] = ttl
+	}
+	if q.DeadLetterExchange != "" || q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if q.MaxPriority > 0 {
+		args["x-max-priority"] = int32(q.MaxPriority)
+	}
+	if q.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// routes 绑定展开为 (路由key, 参数) 列表
+func (b BindingSpec) routes() []struct {
+	key  string
+	args amqp.Table
+} {
+	var args amqp.Table
+	if len(b.Headers) > 0 {
+		args = make(amqp.Table, len(b.Headers)+1)
+		for k, v := range b.Headers {
+			args[k] = v
+		}
+		match := b.Match
+		if match == "" {
+			match = "all"
+		}
+		args["x-match"] = match
+	}
+	keys := b.RoutingKeys
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	routes := make([]struct {
+		key  string
+		args amqp.Table
+	}, 0, len(keys))
+	for _, k := range keys {
+		routes = append(routes, struct {
+			key  string
+			args amqp.Table
+		}{k, args})
+	}
+	return routes
+}
+
+// declare 依次声明交换机、队列与绑定, 重复声明相同定义不会产生影响
+func (t *Topology) declare(ch channel) error {
+	for _, e := range t.Exchanges {
+		if err := ch.ExchangeDeclare(e.Name, e.kind(), e.durable(), e.AutoDelete, e.Internal, false, amqp.Table(e.Arguments)); err != nil {
+			return fmt.Errorf("rabbitmq: declare exchange %q: %w", e.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := ch.QueueDeclare(q.Name, q.durable(), q.AutoDelete, q.Exclusive, false, q.args()); err != nil {
+			return fmt.Errorf("rabbitmq: declare queue %q: %w", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		for _, r := range b.routes() {
+			if err := ch.QueueBind(b.Queue, r.key, b.Exchange, false, r.args); err != nil {
+				return fmt.Errorf("rabbitmq: bind %q -> %q (%s): %w", b.Exchange, b.Queue, r.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Apply 在broker上声明拓扑, 可在启动时重复调用
+func (t *Topology) Apply(ctx context.Context, dns string) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	ch, err := openChannel(ctx, dns)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	return t.declare(ch)
+}
+
+// DiffStatus 拓扑对比结果
+type DiffStatus string
+
+const (
+	DiffOK         DiffStatus = "ok"         // 已存在且定义一致
+	DiffMissing    DiffStatus = "missing"    // 不存在, Apply 时会创建
+	DiffMismatch   DiffStatus = "mismatch"   // 已存在但定义不一致, Apply 会失败
+	DiffUnverified DiffStatus = "unverified" // AMQP协议无法查询, Apply 时会重新声明
+)
+
+// DiffEntry 单个对象的对比结果
+type DiffEntry struct {
+	Kind   string // exchange/queue/binding
+	Name   string
+	Status DiffStatus
+	Detail string
+}
+
+// TopologyDiff 拓扑与broker当前状态的对比
+type TopologyDiff struct {
+	Entries []DiffEntry
+}
+
+// Changes 需要变更或存在冲突的对象
+func (d *TopologyDiff) Changes() []DiffEntry {
+	list := make([]DiffEntry, 0)
+	for _, e := range d.Entries {
+		if e.Status == DiffMissing || e.Status == DiffMismatch {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// String 以文本形式输出对比结果
+func (d *TopologyDiff) String() string {
+	var b strings.Builder
+	for _, e := range d.Entries {
+		b.WriteString(fmt.Sprintf("%-10s %-9s %s", e.Status, e.Kind, e.Name))
+		if e.Detail != "" {
+			b.WriteString("  (" + e.Detail + ")")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Diff 试运行, 对比拓扑定义与broker当前状态, 不会创建任何对象
+// 先被动声明判断是否存在, 存在时再以相同定义声明, broker返回 PRECONDITION_FAILED 即为定义不一致
+// 绑定无法通过AMQP查询, 交换机与队列均存在时标记为 unverified
+func (t *Topology) Diff(ctx context.Context, dns string) (*TopologyDiff, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	diff := &TopologyDiff{}
+	exists := make(map[string]bool)
+
+	// 声明失败时broker会关闭管道, 每次检查都使用新的管道
+	check := func(passive, active func(ch channel) error) (DiffStatus, string, error) {
+		ch, err := openChannel(ctx, dns)
+		if err != nil {
+			return "", "", err
+		}
+		err = passive(ch)
+		_ = ch.Close()
+		if err != nil {
+			var amqpErr *amqp.Error
+			if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+				return DiffMissing, "", nil
+			}
+			return "", "", err
+		}
+		ch, err = openChannel(ctx, dns)
+		if err != nil {
+			return "", "", err
+		}
+		err = active(ch)
+		_ = ch.Close()
+		if err != nil {
+			var amqpErr *amqp.Error
+			if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+				return DiffMismatch, amqpErr.Reason, nil
+			}
+			return "", "", err
+		}
+		return DiffOK, "", nil
+	}
+
+	for _, e := range t.Exchanges {
+		e := e
+		status, detail, err := check(func(ch channel) error {
+			return ch.ExchangeDeclarePassive(e.Name, e.kind(), e.durable(), e.AutoDelete, e.Internal, false, nil)
+		}, func(ch channel) error {
+			return ch.ExchangeDeclare(e.Name, e.kind(), e.durable(), e.AutoDelete, e.Internal, false, amqp.Table(e.Arguments))
+		})
+		if err != nil {
+			return nil, err
+		}
+		exists["exchange:"+e.Name] = status != DiffMissing
+		diff.Entries = append(diff.Entries, DiffEntry{Kind: "exchange", Name: e.Name, Status: status, Detail: detail})
+	}
+	for _, q := range t.Queues {
+		q := q
+		if q.Exclusive {
+			diff.Entries = append(diff.Entries, DiffEntry{Kind: "queue", Name: q.Name, Status: DiffUnverified, Detail: "exclusive queue"})
+			continue
+		}
+		status, detail, err := check(func(ch channel) error {
+			_, err := ch.QueueDeclarePassive(q.Name, q.durable(), q.AutoDelete, q.Exclusive, false, nil)
+			return err
+		}, func(ch channel) error {
+			_, err := ch.QueueDeclare(q.Name, q.durable(), q.AutoDelete, q.Exclusive, false, q.args())
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		exists["queue:"+q.Name] = status != DiffMissing
+		diff.Entries = append(diff.Entries, DiffEntry{Kind: "queue", Name: q.Name, Status: status, Detail: detail})
+	}
+	for _, b := range t.Bindings {
+		for _, r := range b.routes() {
+			name := fmt.Sprintf("%s -> %s [%s]", b.Exchange, b.Queue, r.key)
+			status := DiffUnverified
+			exchangeExists, declared := exists["exchange:"+b.Exchange]
+			if declared && !exchangeExists || !exists["queue:"+b.Queue] {
+				status = DiffMissing
+			}
+			diff.Entries = append(diff.Entries, DiffEntry{Kind: "binding", Name: name, Status: status})
+		}
+	}
+	return diff, nil
+}
+
+// openChannel 使用共享生产者的连接打开一个管道
+func openChannel(ctx context.Context, dns string) (channel, error) {
+	conn := getPublisher(dns).conn
+	if err := conn.WaitReady(ctx); err != nil {
+		return nil, err
+	}
+	return conn.channel()
+}
+
+// topology 一次发布/消费所需声明的交换机、队列与绑定
+type topology struct {
+	exchange     string
+	exchangeType string
+	exchangeArgs amqp.Table
+	queue        string
+	routingKey   string
+	queueArgs    amqp.Table
+	skip         bool          // 拓扑由外部统一管理, 不需要声明
+	redeclare    time.Duration // 发布时重新声明的间隔, 用于刷新 x-expires, 0 为只声明一次
+}
+
+// key 用于缓存已声明的拓扑
+func (t topology) key() string {
+	return strings.Join([]string{t.exchange, t.exchangeType, tableKey(t.exchangeArgs), t.queue, t.routingKey, tableKey(t.queueArgs)}, "|")
+}
+
+// tableKey 参数排序后拼接为字符串
+func tableKey(table amqp.Table) string {
+	args := make([]string, 0, len(table))
+	for k, v := range table {
+		args = append(args, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(args)
+	return strings.Join(args, ",")
+}
+
+// spec 转换为声明式定义
+func (t topology) spec() *Topology {
+	spec := &Topology{}
+	if t.skip {
+		return spec
+	}
+	if t.exchange != "" {
+		spec.Exchanges = append(spec.Exchanges, ExchangeSpec{Name: t.exchange, Type: t.exchangeType, Arguments: t.exchangeArgs})
+	}
+	spec.Queues = append(spec.Queues, QueueSpec{Name: t.queue, Arguments: t.queueArgs})
+	if t.routingKey != "" && t.exchange != "" {
+		spec.Bindings = append(spec.Bindings, BindingSpec{Queue: t.queue, Exchange: t.exchange, RoutingKeys: []string{t.routingKey}})
+	}
+	return spec
+}
+
+// declare 声明交换机、队列并绑定
+func (t topology) declare(ch channel) error {
+	return t.spec().declare(ch)
+}
+
+// target 发布时使用的交换机与路由key, 未配置交换机时直接投递到队列
+func (t topology) target() (exchange, key string) {
+	if t.exchange != "" && t.routingKey != "" {
+		return t.exchange, t.routingKey
+	}
+	return "", t.queue
+}
+
+// queueExchange 由 queueTopology 生成的拓扑还原队列配置, 用于推导延迟等附属拓扑
+func (t topology) queueExchange(dns string) QueueExchange {
+	return QueueExchange{
+		QuName:      t.queue,
+		RtKey:       t.routingKey,
+		ExName:      t.exchange,
+		ExType:      t.exchangeType,
+		Dns:         dns,
+		QueueArgs:   t.queueArgs,
+		SkipDeclare: t.skip,
+	}
+}
+
+// queueTopology 根据 QueueExchange 生成拓扑
+func queueTopology(q QueueExchange) topology {
+	t := topology{
+		exchange:     q.ExName,
+		exchangeType: q.ExType,
+		queue:        q.QuName,
+		routingKey:   q.RtKey,
+		skip:         q.SkipDeclare,
+	}
+	if len(q.QueueArgs) > 0 || q.MaxPriority > 0 {
+		t.queueArgs = make(amqp.Table, len(q.QueueArgs)+1)
+		for k, v := range q.QueueArgs {
+			t.queueArgs[k] = v
+		}
+		if q.MaxPriority > 0 {
+			t.queueArgs["x-max-priority"] = int32(q.MaxPriority)
+		}
+	}
+	return t
+}
@@ -0,0 +1,46 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestLoadTopologyMessageTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "duration string", conf: `message_ttl = "60s"`, want: int64(60000)},
+		{name: "milliseconds", conf: `message_ttl_ms = 60000`, want: int64(60000)},
+		{name: "bare integer", conf: `message_ttl = 60000`, wantErr: true},
+		{name: "both", conf: "message_ttl = \"60s\"\nmessage_ttl_ms = 60000", wantErr: true},
+		{name: "unset", conf: ``, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.SetConfigType("toml")
+			conf := "[[rabbitmq.topology.queues]]\nname = \"order\"\n" + tt.conf
+			if err := v.ReadConfig(bytes.NewBufferString(conf)); err != nil {
+				t.Fatal(err)
+			}
+			topo, err := LoadTopology(v, "rabbitmq.topology")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", topo.Queues[0])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := topo.Queues[0].args()["x-message-ttl"]; got != tt.want {
+				t.Fatalf("x-message-ttl = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
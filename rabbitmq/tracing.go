@@ -0,0 +1,129 @@
+package rabbitmq
+
+import (
+	"context"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	tracinglog "github.com/opentracing/opentracing-go/log"
+	"github.com/streadway/amqp"
+)
+
+// headersCarrier 以AMQP headers作为链路信息的载体
+type headersCarrier amqp.Table
+
+// Set opentracing.TextMapWriter接口实现
+func (c headersCarrier) Set(key, val string) {
+	c[key] = val
+}
+
+// ForeachKey opentracing.TextMapReader接口实现
+func (c headersCarrier) ForeachKey(handler func(key, val string) error) error {
+	for k, v := range c {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if err := handler(k, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startPublishSpan 从ctx中的span创建生产者span, 并将链路信息注入消息headers
+// 未注册全局tracer时不做任何处理
+func startPublishSpan(ctx context.Context, exchange, key string, msg *amqp.Publishing) opentracing.Span {
+	if !opentracing.IsGlobalTracerRegistered() {
+		return nil
+	}
+	span, _ := opentracing.StartSpanFromContext(ctx, "rabbitmq.publish")
+	ext.SpanKindProducer.Set(span)
+	ext.Component.Set(span, "rabbitmq")
+	ext.MessageBusDestination.Set(span, exchange)
+	span.SetTag("rabbitmq.exchange", exchange)
+	span.SetTag("rabbitmq.routing_key", key)
+
+	// 复制headers, 避免修改调用方传入的table
+	headers := make(amqp.Table, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if err := span.Tracer().Inject(span.Context(), opentracing.TextMap, headersCarrier(headers)); err != nil {
+		span.LogFields(tracinglog.Object("inject_err", err))
+	}
+	msg.Headers = headers
+	return span
+}
+
+// finishSpan 结束span, 有错误时标记错误
+func finishSpan(span opentracing.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(tracinglog.Object("err", err))
+	}
+	span.Finish()
+}
+
+// startConsumeSpan 从消息headers中提取链路信息, 创建 FollowsFrom 的消费者span
+// 返回携带span的ctx, 未注册全局tracer时原样返回
+func startConsumeSpan(ctx context.Context, queue string, retryNums int32, msg amqp.Delivery) (opentracing.Span, context.Context) {
+	if !opentracing.IsGlobalTracerRegistered() {
+		return nil, ctx
+	}
+	tracer := opentracing.GlobalTracer()
+	opts := make([]opentracing.StartSpanOption, 0, 2)
+	if parent, err := tracer.Extract(opentracing.TextMap, headersCarrier(msg.Headers)); err == nil {
+		opts = append(opts, opentracing.FollowsFrom(parent))
+	}
+	opts = append(opts, ext.SpanKindConsumer)
+	span := tracer.StartSpan("rabbitmq.consume", opts...)
+	ext.Component.Set(span, "rabbitmq")
+	ext.MessageBusDestination.Set(span, queue)
+	span.SetTag("rabbitmq.exchange", msg.Exchange)
+	span.SetTag("rabbitmq.routing_key", msg.RoutingKey)
+	span.SetTag("rabbitmq.queue", queue)
+	span.SetTag("rabbitmq.retry_nums", retryNums)
+	if msg.MessageId != "" {
+		span.SetTag("rabbitmq.message_id", msg.MessageId)
+	}
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+// detach 只保留ctx中的span, 丢弃其取消与超时
+func detach(ctx context.Context) context.Context {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		return opentracing.ContextWithSpan(context.Background(), span)
+	}
+	return context.Background()
+}
+
+// injectSpan 将ctx中的span注入headers, 用于消息稍后才发布的场景(如发件箱)
+func injectSpan(ctx context.Context, headers amqp.Table) {
+	if !opentracing.IsGlobalTracerRegistered() {
+		return
+	}
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	_ = span.Tracer().Inject(span.Context(), opentracing.TextMap, headersCarrier(headers))
+}
+
+// startFollowSpan 从headers中提取链路信息, 创建 FollowsFrom 的span并返回携带span的ctx
+func startFollowSpan(ctx context.Context, operation string, headers amqp.Table) (opentracing.Span, context.Context) {
+	if !opentracing.IsGlobalTracerRegistered() {
+		return nil, ctx
+	}
+	tracer := opentracing.GlobalTracer()
+	opts := make([]opentracing.StartSpanOption, 0, 1)
+	if parent, err := tracer.Extract(opentracing.TextMap, headersCarrier(headers)); err == nil {
+		opts = append(opts, opentracing.FollowsFrom(parent))
+	}
+	span := tracer.StartSpan(operation, opts...)
+	ext.Component.Set(span, "rabbitmq")
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
@@ -0,0 +1,349 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	// ErrNotObtained 等待超时仍未获取到锁
+	ErrNotObtained = errors.New("redis: lock not obtained")
+	// ErrLockNotHeld 锁已过期或已被其他持有者获取
+	ErrLockNotHeld = errors.New("redis: lock not held")
+)
+
+// 锁保存为hash: token 持有者标识, count 重入次数, fence 获取时的递增序号
+// 序号保存在独立的key中, 不随锁过期, 保证每次获取锁得到的序号单调递增
+// 锁的key为 前缀{name}, 序号的key为 前缀{name}:fence, 两者不会与其他锁重名, 集群模式下位于同一个slot
+var lockObtain = redis.NewScript(`
+local token = redis.call("hget", KEYS[1], "token")
+if not token then
+	local fence = redis.call("incr", KEYS[2])
+	redis.call("hset", KEYS[1], "token", ARGV[1], "count", 1, "fence", fence)
+	redis.call("pexpire", KEYS[1], ARGV[2])
+	return {fence, 1}
+end
+if token == ARGV[1] and ARGV[3] == "1" then
+	local count = redis.call("hincrby", KEYS[1], "count", 1)
+	redis.call("pexpire", KEYS[1], ARGV[2])
+	return {tonumber(redis.call("hget", KEYS[1], "fence")), count}
+end
+return {0, 0}
+`)
+
+// lockRelease 只释放自己持有的锁, 重入时减少计数, 返回剩余计数, 未持有时返回-1
+var lockRelease = redis.NewScript(`
+if redis.call("hget", KEYS[1], "token") ~= ARGV[1] then
+	return -1
+end
+local count = redis.call("hincrby", KEYS[1], "count", -1)
+if count > 0 then
+	redis.call("pexpire", KEYS[1], ARGV[2])
+	return count
+end
+redis.call("del", KEYS[1])
+return 0
+`)
+
+// lockRefresh 只续期自己持有的锁
+var lockRefresh = redis.NewScript(`
+if redis.call("hget", KEYS[1], "token") == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// LockOptions 分布式锁配置
+type LockOptions struct {
+	Client          *redis.Client // redis客户端, 默认为 Get()
+	Prefix          string        // key前缀, 默认 lock:, 锁的key为 lock:{name}
+	TTL             time.Duration // 锁的租期, 持有者崩溃后最长经过该时长锁被释放, 默认30秒
+	Timeout         time.Duration // 获取锁的最长等待时间, 0 为只尝试一次
+	RetryInterval   time.Duration // 获取失败后的重试间隔, 实际间隔在 [1/2, 1] 倍之间随机, 默认100毫秒
+	DisableWatchdog bool          // 关闭自动续期, 默认持有期间每 TTL/3 续期一次
+	Reentrant       bool          // 可重入, 通过 Lock.Context 返回的ctx再次获取同名锁时增加重入计数
+}
+
+// Lock 已获取的分布式锁
+type Lock struct {
+	client *redis.Client
+	key    string
+	token  string
+	fence  int64
+	ttl    time.Duration
+
+	mu       sync.Mutex
+	released bool
+	lost     chan struct{} // 锁丢失或已释放时关闭
+	stop     chan struct{}
+	done     chan struct{} // 续期协程已退出
+}
+
+// heldKey ctx中记录已持有的锁, 用于重入
+type heldKey struct {
+	key string
+}
+
+// Obtain 获取分布式锁, 等待最长 opts.Timeout, 超时返回 ErrNotObtained
+//
+// 获取成功后默认启动续期协程, 持有期间锁不会过期
+// 锁已被他人获取, 或连续续期失败超过 TTL 减去一个续期间隔时 Done 会关闭, 此时锁在redis中尚未过期, 持有者应停止写入
+// 每次获取都会得到单调递增的 Fence 序号, 下游写入时比较序号即可拒绝已失去锁的旧持有者
+func Obtain(ctx context.Context, name string, opts LockOptions) (*Lock, error) {
+	if opts.Client == nil {
+		opts.Client = Get()
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "lock:"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 30 * time.Second
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 100 * time.Millisecond
+	}
+
+	key := opts.Prefix + "{" + name + "}"
+	token, _ := ctx.Value(heldKey{key}).(string)
+	if token == "" || !opts.Reentrant {
+		token = newLockToken()
+	}
+
+	var deadline <-chan time.Time
+	if opts.Timeout > 0 {
+		t := time.NewTimer(opts.Timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	for {
+		fence, count, err := obtain(ctx, opts, key, token)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			lk := &Lock{
+				client: opts.Client,
+				key:    key,
+				token:  token,
+				fence:  fence,
+				ttl:    opts.TTL,
+				lost:   make(chan struct{}),
+				stop:   make(chan struct{}),
+				done:   make(chan struct{}),
+			}
+			// 重入时由最外层的持有者续期
+			if opts.DisableWatchdog || count > 1 {
+				close(lk.done)
+			} else {
+				go lk.watchdog()
+			}
+			return lk, nil
+		}
+		if deadline == nil {
+			return nil, ErrNotObtained
+		}
+
+		wait := opts.RetryInterval/2 + time.Duration(mrand.Int63n(int64(opts.RetryInterval/2)+1))
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-deadline:
+			t.Stop()
+			return nil, ErrNotObtained
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// WithLock 获取锁后执行 fn, 执行结束后释放锁
+// fn 收到的ctx在锁丢失时取消, 开启重入时可用于再次获取同名锁
+func WithLock(ctx context.Context, name string, opts LockOptions, fn func(ctx context.Context) error) error {
+	lk, err := Obtain(ctx, name, opts)
+	if err != nil {
+		return err
+	}
+	lctx, cancel := context.WithCancel(lk.Context(ctx))
+	defer cancel()
+	go func() {
+		select {
+		case <-lk.Done():
+			cancel()
+		case <-lctx.Done():
+		}
+	}()
+
+	err = fn(lctx)
+	if releaseErr := lk.Release(context.Background()); releaseErr != nil && err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// obtain 尝试获取一次, count 为0表示锁被他人持有
+func obtain(ctx context.Context, opts LockOptions, key, token string) (fence, count int64, err error) {
+	reentrant := "0"
+	if opts.Reentrant {
+		reentrant = "1"
+	}
+	v, err := lockObtain.Run(ctx, opts.Client, []string{key, key + ":fence"}, token, opts.TTL.Milliseconds(), reentrant).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	res, ok := v.([]interface{})
+	if !ok || len(res) != 2 {
+		return 0, 0, fmt.Errorf("redis: unexpected lock reply %v", v)
+	}
+	fence, _ = res[0].(int64)
+	count, _ = res[1].(int64)
+	return fence, count, nil
+}
+
+// Key 锁在redis中的key
+func (lk *Lock) Key() string {
+	return lk.key
+}
+
+// Token 持有者标识
+func (lk *Lock) Token() string {
+	return lk.token
+}
+
+// Fence 获取锁时分配的递增序号, 重入时与最外层相同
+func (lk *Lock) Fence() int64 {
+	return lk.fence
+}
+
+// Done 锁丢失或已释放时关闭, 重入获取的锁由最外层续期, 其 Done 只在释放时关闭
+func (lk *Lock) Done() <-chan struct{} {
+	return lk.lost
+}
+
+// Context 返回记录了当前锁的ctx, 开启重入时使用该ctx再次获取同名锁会重入而不是等待
+func (lk *Lock) Context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, heldKey{lk.key}, lk.token)
+}
+
+// TTL 锁的剩余有效期, 锁已不属于当前持有者时返回 ErrLockNotHeld
+func (lk *Lock) TTL(ctx context.Context) (time.Duration, error) {
+	res, err := lk.client.HGet(ctx, lk.key, "token").Result()
+	if err == redis.Nil || (err == nil && res != lk.token) {
+		return 0, ErrLockNotHeld
+	}
+	if err != nil {
+		return 0, err
+	}
+	return lk.client.PTTL(ctx, lk.key).Result()
+}
+
+// Refresh 将锁的有效期重置为 ttl, ttl 小于等于0时使用获取时的租期
+func (lk *Lock) Refresh(ctx context.Context, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = lk.ttl
+	}
+	ok, err := lockRefresh.Run(ctx, lk.client, []string{lk.key}, lk.token, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// Release 释放锁, 重入时只减少一次计数; 锁已过期或被他人持有时返回 ErrLockNotHeld
+func (lk *Lock) Release(ctx context.Context) error {
+	lk.mu.Lock()
+	if lk.released {
+		lk.mu.Unlock()
+		return ErrLockNotHeld
+	}
+	lk.released = true
+	close(lk.stop)
+	lk.mu.Unlock()
+	<-lk.done
+
+	defer lk.markLost()
+	n, err := lockRelease.Run(ctx, lk.client, []string{lk.key}, lk.token, lk.ttl.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// watchdog 每 TTL/3 续期一次, 锁已不属于当前持有者时结束
+// 续期持续失败时在锁过期前一个续期间隔放弃, 保证 Done 关闭时其他持有者还无法获取锁
+func (lk *Lock) watchdog() {
+	defer close(lk.done)
+	interval := lk.ttl / 3
+	if interval <= 0 {
+		interval = lk.ttl
+	}
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	// 最近一次续期成功时锁至少有效到 renewed+ttl, 最晚在 renewed+ttl-interval 放弃
+	renewed := time.Now()
+	for {
+		select {
+		case <-lk.stop:
+			return
+		case <-t.C:
+		}
+		giveUp := renewed.Add(lk.ttl - interval)
+		start := time.Now()
+		deadline := start.Add(interval)
+		if giveUp.Before(deadline) {
+			deadline = giveUp
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := lk.Refresh(ctx, lk.ttl)
+		cancel()
+		switch {
+		case err == nil:
+			renewed = start
+		case err == ErrLockNotHeld || !time.Now().Before(giveUp):
+			fmt.Printf("[lock] %s 续期失败, 锁已丢失 :%s \n", lk.key, err)
+			lk.markLost()
+			return
+		default:
+			fmt.Printf("[lock] %s 续期失败, 稍后重试 :%s \n", lk.key, err)
+		}
+		next := interval
+		if err != nil {
+			if d := time.Until(giveUp); d < next {
+				next = d
+			}
+		}
+		t.Reset(next)
+	}
+}
+
+// markLost 关闭 Done
+func (lk *Lock) markLost() {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	select {
+	case <-lk.lost:
+	default:
+		close(lk.lost)
+	}
+}
+
+// newLockToken 随机的持有者标识
+func newLockToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
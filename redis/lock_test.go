@@ -0,0 +1,206 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestLockOptions 每个测试独立的 miniredis
+func newTestLockOptions(t *testing.T) (*miniredis.Miniredis, LockOptions) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { _ = client.Close() })
+	return mr, LockOptions{Client: client, TTL: time.Second}
+}
+
+func TestLockReentrant(t *testing.T) {
+	mr, opts := newTestLockOptions(t)
+	opts.Reentrant = true
+	ctx := context.Background()
+
+	outer, err := Obtain(ctx, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Obtain(ctx, "job", opts); err != ErrNotObtained {
+		t.Fatalf("obtain without held ctx = %v, want ErrNotObtained", err)
+	}
+	inner, err := Obtain(outer.Context(ctx), "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.Fence() != outer.Fence() {
+		t.Fatalf("reentrant fence = %d, want %d", inner.Fence(), outer.Fence())
+	}
+	if got := mr.HGet(outer.Key(), "count"); got != "2" {
+		t.Fatalf("count = %s, want 2", got)
+	}
+
+	if err := inner.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet(outer.Key(), "count"); got != "1" {
+		t.Fatalf("count after inner release = %s, want 1", got)
+	}
+	select {
+	case <-outer.Done():
+		t.Fatal("outer lock lost after inner release")
+	default:
+	}
+	if err := outer.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(outer.Key()) {
+		t.Fatal("lock key still exists after outer release")
+	}
+
+	opts.Reentrant = false
+	lk, err := Obtain(ctx, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lk.Release(ctx)
+	if _, err := Obtain(lk.Context(ctx), "job", opts); err != ErrNotObtained {
+		t.Fatalf("obtain non-reentrant = %v, want ErrNotObtained", err)
+	}
+}
+
+func TestLockReleaseByOtherToken(t *testing.T) {
+	mr, opts := newTestLockOptions(t)
+	opts.DisableWatchdog = true
+	ctx := context.Background()
+
+	lk, err := Obtain(ctx, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 锁过期后被其他持有者获取
+	mr.FastForward(opts.TTL)
+	other, err := Obtain(ctx, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lk.Release(ctx); err != ErrLockNotHeld {
+		t.Fatalf("release by old holder = %v, want ErrLockNotHeld", err)
+	}
+	if got := mr.HGet(lk.Key(), "token"); got != other.Token() {
+		t.Fatalf("token = %s, want the new holder's", got)
+	}
+	if err := lk.Release(ctx); err != ErrLockNotHeld {
+		t.Fatalf("second release = %v, want ErrLockNotHeld", err)
+	}
+	if err := other.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockFenceMonotonic(t *testing.T) {
+	mr, opts := newTestLockOptions(t)
+	opts.DisableWatchdog = true
+	ctx := context.Background()
+
+	var last int64
+	for i := 0; i < 3; i++ {
+		lk, err := Obtain(ctx, "job", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lk.Fence() <= last {
+			t.Fatalf("fence %d not greater than %d", lk.Fence(), last)
+		}
+		last = lk.Fence()
+		if i == 1 {
+			// 过期而不是释放, 序号同样递增
+			mr.FastForward(opts.TTL)
+			continue
+		}
+		if err := lk.Release(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 名称以 :fence 结尾的锁不会与序号key冲突
+	lk, err := Obtain(ctx, "job:fence", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lk.Fence() != 1 {
+		t.Fatalf("fence of job:fence = %d, want 1", lk.Fence())
+	}
+	if err := lk.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockWatchdog(t *testing.T) {
+	t.Run("renews", func(t *testing.T) {
+		mr, opts := newTestLockOptions(t)
+		opts.TTL = 300 * time.Millisecond
+		lk, err := Obtain(context.Background(), "job", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 每个续期间隔后模拟时间流逝 2/3 TTL, 未续期时第二次即过期
+		for i := 0; i < 3; i++ {
+			time.Sleep(opts.TTL / 2)
+			mr.FastForward(opts.TTL * 2 / 3)
+		}
+		if !mr.Exists(lk.Key()) {
+			t.Fatal("lock expired while watchdog is renewing")
+		}
+		select {
+		case <-lk.Done():
+			t.Fatal("lock lost while watchdog is renewing")
+		default:
+		}
+		if err := lk.Release(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		<-lk.Done()
+	})
+
+	t.Run("taken over", func(t *testing.T) {
+		mr, opts := newTestLockOptions(t)
+		opts.TTL = 300 * time.Millisecond
+		lk, err := Obtain(context.Background(), "job", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr.HSet(lk.Key(), "token", "other")
+		select {
+		case <-lk.Done():
+		case <-time.After(opts.TTL):
+			t.Fatal("Done not closed after the lock was taken over")
+		}
+	})
+
+	t.Run("redis unavailable", func(t *testing.T) {
+		mr, opts := newTestLockOptions(t)
+		opts.TTL = 900 * time.Millisecond
+		interval := opts.TTL / 3
+		start := time.Now()
+		lk, err := Obtain(context.Background(), "job", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr.SetError("ERR unavailable")
+		select {
+		case <-lk.Done():
+		case <-time.After(opts.TTL):
+			t.Fatal("Done not closed before the lock expired")
+		}
+		// 在锁过期前一个续期间隔放弃, 不早于此前的最后一次续期
+		if elapsed := time.Since(start); elapsed < interval || elapsed > opts.TTL-interval/2 {
+			t.Fatalf("lock marked lost after %v, want about %v", elapsed, opts.TTL-interval)
+		}
+	})
+}